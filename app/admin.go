@@ -0,0 +1,209 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// listStores returns settings of every store, sorted by name
+func (ctx *Context) listStores(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx.storesLock.RLock()
+	stores := make([]Store, 0, len(ctx.stores))
+	for _, store := range ctx.stores {
+		// credentials presented to remote stores are not listed
+		config := store.config
+		config.SyncToken, config.ReplicateToken = "", ""
+		stores = append(stores, config)
+	}
+	ctx.storesLock.RUnlock()
+
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+
+	jsRes, err := json.Marshal(stores)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
+
+// addStore creates store with settings from request, persisted to StoresFile so it is opened on restart
+// settings missing from request are defaulted same as configuration file
+func (ctx *Context) addStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	jsReq, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, readErrorStatus(err), err.Error())
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cfg, err := ctx.config.decodeStore(jsReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if status, err := ctx.reserveStore(cfg); err != nil {
+		respondWithError(w, status, err.Error())
+		return
+	}
+	// store is opened outside of storesLock, restoring it from backup could take a while
+	store, err := ctx.openStore(cfg)
+	if err != nil {
+		ctx.storesLock.Lock()
+		delete(ctx.pendingStores, cfg.Name)
+		ctx.storesLock.Unlock()
+		closeStore(store)
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx.storesLock.Lock()
+	delete(ctx.pendingStores, cfg.Name)
+	ctx.config.Stores = append(ctx.config.Stores, cfg)
+	if err := ctx.config.saveRuntimeStores(); err != nil {
+		ctx.config.Stores = ctx.config.Stores[:len(ctx.config.Stores)-1]
+		ctx.storesLock.Unlock()
+		closeStore(store)
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.stores[cfg.Name] = store
+	ctx.storesLock.Unlock()
+
+	slog.Info("created store", "store", cfg.Name)
+	respondOK(w, "ok")
+}
+
+// reserveStore name and directories of store being created, unless they are used by another store
+// directories holding files are refused, as they are removed when the store is dropped
+func (ctx *Context) reserveStore(cfg Store) (int, error) {
+	ctx.storesLock.Lock()
+	defer ctx.storesLock.Unlock()
+
+	if err := ctx.checkNewStore(cfg); err != nil {
+		return http.StatusConflict, err
+	}
+	for _, dir := range []string{cfg.Backupdir, cfg.WALDir} {
+		if len(dir) > 0 && !emptyDir(dir) {
+			return http.StatusConflict, fmt.Errorf("store %s: directory %s already holds files", cfg.Name, dir)
+		}
+	}
+	ctx.pendingStores[cfg.Name] = cfg
+	return http.StatusOK, nil
+}
+
+// checkNewStore name and directories are not used by open stores or stores being opened, storesLock is held by the caller
+func (ctx *Context) checkNewStore(cfg Store) error {
+	if _, ok := ctx.stores[cfg.Name]; ok {
+		return fmt.Errorf("store %s already exists", cfg.Name)
+	}
+	if _, ok := ctx.pendingStores[cfg.Name]; ok {
+		return fmt.Errorf("store %s is being created", cfg.Name)
+	}
+	for _, used := range ctx.storeConfigs() {
+		if conflict := sharedStoreDir(used, cfg); len(conflict) > 0 {
+			return fmt.Errorf("store %s: directory %s is used by store %s", cfg.Name, conflict, used.Name)
+		}
+	}
+	return nil
+}
+
+// storeConfigs of open stores and stores being opened, storesLock is held by the caller
+func (ctx *Context) storeConfigs() []Store {
+	configs := make([]Store, 0, len(ctx.stores)+len(ctx.pendingStores))
+	for _, store := range ctx.stores {
+		configs = append(configs, store.config)
+	}
+	for _, cfg := range ctx.pendingStores {
+		configs = append(configs, cfg)
+	}
+	return configs
+}
+
+// dropStore shuts down store created at runtime and removes its files
+// stores from configuration file are dropped by removing them from the file
+func (ctx *Context) dropStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+
+	ctx.storesLock.Lock()
+	store, ok := ctx.stores[storeName]
+	if !ok {
+		ctx.storesLock.Unlock()
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !store.config.Runtime {
+		ctx.storesLock.Unlock()
+		err := fmt.Sprintf("store %s is defined in configuration file", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	index, _ := ctx.config.findStore(storeName)
+	stores := ctx.config.Stores
+	ctx.config.Stores = append(append([]Store{}, stores[:index]...), stores[index+1:]...)
+	if err := ctx.config.saveRuntimeStores(); err != nil {
+		ctx.config.Stores = stores
+		ctx.storesLock.Unlock()
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	delete(ctx.stores, storeName)
+	ctx.storesLock.Unlock()
+
+	// requests which looked up the store before it was dropped fail once it is shutdown
+	if err := closeStore(store); err != nil {
+		slog.Error("error shutting down dropped store", "store", storeName, "error", err)
+	}
+	// store is already dropped, files left behind are only logged
+	for _, dir := range []string{store.config.Backupdir, store.config.WALDir, store.snapshotter.dir} {
+		if len(dir) == 0 {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("error removing files of dropped store", "store", storeName, "dir", dir, "error", err)
+		}
+	}
+
+	slog.Info("dropped store", "store", storeName)
+	respondOK(w, "ok")
+}
+
+// sharedStoreDir returns directory of created store overlapping one used by store, removed when either is dropped
+func sharedStoreDir(store, created Store) string {
+	dirs := []string{store.Backupdir, store.WALDir}
+	for _, dir := range []string{created.Backupdir, created.WALDir} {
+		if len(dir) == 0 {
+			continue
+		}
+		for _, used := range dirs {
+			if len(used) > 0 && (nestedDir(used, dir) || nestedDir(dir, used)) {
+				return dir
+			}
+		}
+	}
+	return ""
+}
+
+// nestedDir reports whether dir is parent or same as child
+func nestedDir(dir, child string) bool {
+	rel, err := filepath.Rel(absDir(dir), absDir(child))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
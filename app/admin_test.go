@@ -0,0 +1,129 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// requestStatus sends request returning response status code
+func requestStatus(method, url string, buf []byte) (int, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(buf))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestRuntimeStores(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+`)
+
+	os.RemoveAll("./runtimestoretest")
+	defer os.RemoveAll("./runtimestoretest")
+	// directories holding files of others are never used, as they would be removed on drop
+	const usedDir string = "./runtimestoreused"
+	os.MkdirAll(usedDir, os.ModePerm)
+	defer os.RemoveAll(usedDir)
+	if err := ioutil.WriteFile(usedDir+"/data", []byte("data"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	absRuntimeDir, _ := filepath.Abs("./runtimestoretest")
+	os.Remove("./stores.json")
+	defer os.Remove("./stores.json")
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(1 * time.Second)
+
+	const storesURL string = "http://127.0.0.1:8080/v1/stores"
+	created := []byte(`{"Name": "runtime", "Backup": "BoltDB", "Backupdir": "./runtimestoretest"}`)
+	for _, test := range []struct {
+		request  []byte
+		expected int
+	}{
+		{created, http.StatusOK},
+		{created, http.StatusConflict},
+		{[]byte(`{"Name": "other", "Backup": "BoltDB", "Backupdir": "./runtimestoretest/other"}`), http.StatusConflict},
+		{[]byte(`{"Name": "other", "Backup": "BoltDb", "Backupdir": "./other"}`), http.StatusBadRequest},
+		{[]byte(`{"Name": "other", "Backupdir": "."}`), http.StatusBadRequest},
+		{[]byte(`{"Name": "other", "Backup": "BoltDB", "Backupdir": "/var/lib"}`), http.StatusBadRequest},
+		{[]byte(`{"Name": "other", "Backup": "BoltDB", "Backupdir": "` + usedDir + `"}`), http.StatusConflict},
+		{[]byte(`{"Name": "other", "WALDir": "` + absRuntimeDir + `/wal"}`), http.StatusConflict},
+		{[]byte(`{"Name": "other/store"}`), http.StatusBadRequest},
+		{[]byte(`{"Name": "other", "Unknown": 1}`), http.StatusBadRequest},
+		{[]byte(`{"Name": "other", "SyncTimeoutSec": 0}`), http.StatusBadRequest},
+		{[]byte(`{"Name": "other", "SyncMaxBackoffSec": -1}`), http.StatusBadRequest},
+	} {
+		status, err := requestStatus("POST", storesURL, test.request)
+		if err != nil || status != test.expected {
+			t.Errorf("Expected creating store %s to return %d, found %d, %v", string(test.request), test.expected, status, err)
+		}
+	}
+
+	if err := postStore("http://127.0.0.1:8080/v1/store/runtime/update", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+	}
+
+	var stores []Store
+	if err := getJSON(storesURL, &stores); err != nil || len(stores) != 2 || stores[0].Name != "local" || stores[1].Name != "runtime" || !stores[1].Runtime {
+		t.Errorf("Expected local and runtime stores, found %+v, %v", stores, err)
+	}
+	DeleteContext(ctx)
+
+	// created store is opened again on restart with its contents
+	ctx, err = CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	keys, err := queryStoreKeys("http://127.0.0.1:8080/v1/store/runtime/query", []byte(`{"num": "6.13"}`))
+	if err != nil || len(keys) != 1 || keys[0] != "m1" {
+		t.Errorf("Expected created store restored after restart, found %v, %v", keys, err)
+	}
+
+	if status, err := requestStatus("DELETE", storesURL+"/local", nil); err != nil || status != http.StatusBadRequest {
+		t.Errorf("Expected store from configuration file not dropped, found %d, %v", status, err)
+	}
+	if status, err := requestStatus("DELETE", storesURL+"/runtime", nil); err != nil || status != http.StatusOK {
+		t.Errorf("Expected created store dropped, found %d, %v", status, err)
+	}
+	if _, err := os.Stat("./runtimestoretest"); !os.IsNotExist(err) {
+		t.Errorf("Expected files of dropped store removed, found %v", err)
+	}
+	if _, err := os.Stat(usedDir + "/data"); err != nil {
+		t.Errorf("Expected files of refused store kept, found %v", err)
+	}
+	if err := getJSON(storesURL, &stores); err != nil || len(stores) != 1 {
+		t.Errorf("Expected only local store, found %+v, %v", stores, err)
+	}
+	if status, err := requestStatus("POST", "http://127.0.0.1:8080/v1/store/runtime/query", []byte(`{"num": "6.13"}`)); err != nil || status != http.StatusBadRequest {
+		t.Errorf("Expected dropped store not found, found %d, %v", status, err)
+	}
+}
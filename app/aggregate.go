@@ -0,0 +1,424 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+)
+
+// aggregateCursorMeta prefix of backup store meta blobs holding per url sync cursor
+const aggregateCursorMeta string = "aggregate-cursor:"
+
+// aggregateSourceMeta prefix of backup store meta blobs holding associations reported by each url
+const aggregateSourceMeta string = "aggregate-source:"
+
+// aggregateSourceSaveInterval between persisting associations reported by an url synced incrementally
+// every save rewrites all of them, restarts resume from the saved cursor replaying the changes since
+const aggregateSourceSaveInterval time.Duration = time.Minute
+
+// syncChangesLimit maximum number of changes pulled from remote store in one request
+const syncChangesLimit int = 10000
+
+// changesResponse returned by changes endpoint
+// cursor should be presented in the next request to continue after these changes
+type changesResponse struct {
+	Cursor  string        `json:"cursor"`
+	Changes []core.Change `json:"changes"`
+}
+
+// aggregateSource sync state of a single remote store
+type aggregateSource struct {
+	url          string
+	cursor       string
+	failures     int
+	nextAttempt  time.Time
+	syncing      bool
+	lastAttempt  time.Time
+	lastSuccess  time.Time
+	failingSince time.Time
+	lastError    error
+	lastResult   aggregateSyncResult
+	lastDuration time.Duration
+	// cursor persisted along with associations and when
+	savedCursor string
+	savedAt     time.Time
+}
+
+// aggregateSyncResult details of a single sync of an aggregate url
+type aggregateSyncResult struct {
+	cursor  string
+	bytes   int
+	entries int
+	full    bool
+}
+
+// aggregateURLStatus reports sync state of an aggregate url
+type aggregateURLStatus struct {
+	URL                 string     `json:"url"`
+	Syncing             bool       `json:"syncing"`
+	Degraded            bool       `json:"degraded"`
+	LastAttempt         *time.Time `json:"lastAttempt,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	FailingSince        *time.Time `json:"failingSince,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	NextAttempt         *time.Time `json:"nextAttempt,omitempty"`
+	FullSync            bool       `json:"fullSync"`
+	PayloadBytes        int        `json:"payloadBytes"`
+	DurationMs          int64      `json:"durationMs"`
+	EntriesMerged       int        `json:"entriesMerged"`
+}
+
+// aggregateSync pulls remote stores into an aggregate store
+// each remote url is fetched independently, bounded by parallel slots,
+// so that a slow or failing url does not stall others
+type aggregateSync struct {
+	store      *CoreStores
+	client     *http.Client
+	token      string
+	interval   time.Duration
+	maxBackoff time.Duration
+	threshold  time.Duration
+	sources    []*aggregateSource
+	slots      chan struct{}
+	lock       sync.Mutex
+	inflight   sync.WaitGroup
+	reqCtx     context.Context
+	cancel     context.CancelFunc
+}
+
+// SyncAggregateURLs performs sync of key values from remote stores
+// pulls only changes since the last sync using per url cursor,
+// falling back to full sync from backup when cursor is missing or invalid
+// every association is tracked along with the url which reported it, full sync
+// reconciles the url's set removing associations it no longer reports
+// failing urls are retried with exponential backoff and jitter upto SyncMaxBackoff
+func (ctx *Context) SyncAggregateURLs(store *CoreStores) {
+	// sync is restarted with new channel and syncer when configuration is reloaded
+	shutdown, syncer := store.shutdown, store.syncer
+	defer close(shutdown)
+	ticker := time.NewTicker(syncer.interval)
+	for {
+		select {
+		case <-ticker.C:
+			syncer.syncDue(time.Now())
+		case <-shutdown:
+			ticker.Stop()
+			// abort pending requests and wait for them before stores are shutdown
+			syncer.cancel()
+			syncer.inflight.Wait()
+			syncer.saveSources()
+			return
+		}
+	}
+}
+
+func newAggregateSync(store *CoreStores, cfg Store, transport http.RoundTripper) *aggregateSync {
+	if cfg.SyncParallel < 1 {
+		cfg.SyncParallel = 1
+	}
+	syncer := &aggregateSync{
+		store:      store,
+		client:     &http.Client{Transport: transport, Timeout: time.Duration(cfg.SyncTimeoutSec) * time.Second},
+		token:      cfg.SyncToken,
+		interval:   time.Duration(cfg.SyncIntervalSec) * time.Second,
+		maxBackoff: time.Duration(cfg.SyncMaxBackoffSec) * time.Second,
+		threshold:  time.Duration(cfg.SyncFailureThresholdSec) * time.Second,
+		slots:      make(chan struct{}, cfg.SyncParallel),
+	}
+	syncer.reqCtx, syncer.cancel = context.WithCancel(context.Background())
+
+	cursors := loadAggregateCursors(store, cfg.AggregateURLs)
+	for _, aggregateURL := range cfg.AggregateURLs {
+		syncer.sources = append(syncer.sources, &aggregateSource{url: aggregateURL, cursor: cursors[aggregateURL], savedCursor: cursors[aggregateURL]})
+	}
+	return syncer
+}
+
+// syncDue starts sync of every url which is not already syncing or backing off
+func (s *aggregateSync) syncDue(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, source := range s.sources {
+		if source.syncing || now.Before(source.nextAttempt) {
+			continue
+		}
+		source.syncing = true
+		s.inflight.Add(1)
+		go s.syncSource(source, source.cursor)
+	}
+}
+
+func (s *aggregateSync) syncSource(source *aggregateSource, cursor string) {
+	defer s.inflight.Done()
+
+	s.slots <- struct{}{}
+	start := time.Now()
+	result := aggregateSyncResult{cursor: cursor}
+	err := s.syncAggregateURL(source.url, &result)
+	duration := time.Since(start)
+	<-s.slots
+	metrics.observeSync(s.store.config.Name, source.url, err, duration)
+
+	// full syncs are always saved, so restarts don't repeat them
+	if err == nil && result.cursor != cursor && (result.full || time.Since(source.savedAt) >= aggregateSourceSaveInterval) {
+		saveAggregateSource(s.store, source.url, result.cursor)
+		source.savedCursor, source.savedAt = result.cursor, time.Now()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	source.syncing = false
+	source.lastAttempt = start
+	source.lastError = err
+	source.lastResult = result
+	source.lastDuration = duration
+	if err != nil {
+		if source.failures == 0 {
+			source.failingSince = start
+		}
+		source.failures++
+		backoff := s.backoff(source.failures)
+		source.nextAttempt = time.Now().Add(backoff)
+		slog.Error("error syncing aggregate url", "url", source.url, "failures", source.failures, "retry_in", backoff.String(), "error", err)
+		return
+	}
+	source.cursor = result.cursor
+	source.failures = 0
+	source.failingSince = time.Time{}
+	source.nextAttempt = time.Time{}
+	source.lastSuccess = start
+}
+
+// saveSources persists urls synced since they were last saved, called once syncs are stopped
+func (s *aggregateSync) saveSources() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, source := range s.sources {
+		if source.cursor != source.savedCursor {
+			saveAggregateSource(s.store, source.url, source.cursor)
+			source.savedCursor, source.savedAt = source.cursor, time.Now()
+		}
+	}
+}
+
+// status of every url, a url is degraded when it has been failing longer than threshold
+func (s *aggregateSync) status(now time.Time) []aggregateURLStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	statuses := make([]aggregateURLStatus, 0, len(s.sources))
+	for _, source := range s.sources {
+		status := aggregateURLStatus{
+			URL:                 source.url,
+			Syncing:             source.syncing,
+			Degraded:            source.failures > 0 && now.Sub(source.failingSince) > s.threshold,
+			LastAttempt:         timeRef(source.lastAttempt),
+			LastSuccess:         timeRef(source.lastSuccess),
+			FailingSince:        timeRef(source.failingSince),
+			ConsecutiveFailures: source.failures,
+			NextAttempt:         timeRef(source.nextAttempt),
+			FullSync:            source.lastResult.full,
+			PayloadBytes:        source.lastResult.bytes,
+			DurationMs:          int64(source.lastDuration / time.Millisecond),
+			EntriesMerged:       source.lastResult.entries,
+		}
+		if source.lastError != nil {
+			status.LastError = source.lastError.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// timeRef returns nil for zero time, so it is omitted from JSON
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// backoff for url with consecutive failures
+func (s *aggregateSync) backoff(failures int) time.Duration {
+	return syncBackoff(s.interval, s.maxBackoff, failures)
+}
+
+// syncBackoff doubles interval for every consecutive failure upto maxBackoff,
+// randomized over the upper half so failing urls are not retried in lockstep
+func syncBackoff(interval, maxBackoff time.Duration, failures int) time.Duration {
+	if failures > 16 {
+		failures = 16
+	}
+	backoff := interval << uint(failures)
+	if backoff <= 0 || backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// syncAggregateURL merges remote changes after result cursor, advancing the cursor
+func (s *aggregateSync) syncAggregateURL(aggregateURL string, result *aggregateSyncResult) error {
+	if len(result.cursor) > 0 {
+		err := s.pullAggregateChanges(aggregateURL, result)
+		if err != core.ErrCursorInvalid {
+			return err
+		}
+		slog.Warn("cursor for aggregate url is no longer valid, performing full sync", "url", aggregateURL)
+	}
+	return s.fullSyncAggregateURL(aggregateURL, result)
+}
+
+// pullAggregateChanges applies remote changes in batches until caught up
+func (s *aggregateSync) pullAggregateChanges(aggregateURL string, result *aggregateSyncResult) error {
+	for {
+		changesURL := aggregateURL + "/changes?since=" + url.QueryEscape(result.cursor) + "&limit=" + strconv.Itoa(syncChangesLimit)
+		var changes changesResponse
+		if err := s.getAggregateJSON(changesURL, &changes, result); err != nil {
+			return err
+		}
+
+		if err := s.store.applySourceChanges(aggregateURL, changes.Changes, false); err != nil {
+			return err
+		}
+
+		result.cursor = changes.Cursor
+		result.entries += len(changes.Changes)
+		if len(changes.Changes) < syncChangesLimit {
+			return nil
+		}
+	}
+}
+
+// fullSyncAggregateURL reconciles complete remote backup with associations previously reported by url
+// cursor is taken before the backup, so changes made in between are pulled again, which is harmless
+func (s *aggregateSync) fullSyncAggregateURL(aggregateURL string, result *aggregateSyncResult) error {
+	result.full = true
+
+	var changes changesResponse
+	if err := s.getAggregateJSON(aggregateURL+"/changes", &changes, result); err != nil {
+		return err
+	}
+
+	bodyBytes, err := s.getAggregateURL(aggregateURL+"/backup", result)
+	if err != nil {
+		return err
+	}
+
+	backupChanges, err := core.ParseSerialized(bodyBytes)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.applySourceChanges(aggregateURL, backupChanges, true); err != nil {
+		return err
+	}
+
+	result.cursor = changes.Cursor
+	result.entries += len(backupChanges)
+	return nil
+}
+
+// getAggregateJSON fetches remoteURL and decodes JSON response into v
+func (s *aggregateSync) getAggregateJSON(remoteURL string, v interface{}, result *aggregateSyncResult) error {
+	bodyBytes, err := s.getAggregateURL(remoteURL, result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bodyBytes, v)
+}
+
+// getAggregateURL fetches remoteURL, a gone response means the presented cursor is invalid
+// any other non success response is an error, body is not deserialized
+func (s *aggregateSync) getAggregateURL(remoteURL string, result *aggregateSyncResult) ([]byte, error) {
+	httpReq, err := http.NewRequest("GET", remoteURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setAuthorization(httpReq, s.token)
+
+	httpResp, httpErr := s.client.Do(httpReq.WithContext(s.reqCtx))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	bodyBytes, rerr := ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	result.bytes += len(bodyBytes)
+
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+		return bodyBytes, nil
+	case http.StatusGone:
+		return nil, core.ErrCursorInvalid
+	}
+	return nil, fmt.Errorf("%s returned %s", remoteURL, httpResp.Status)
+}
+
+// loadAggregateCursors restores cursors and reported associations persisted in backup store
+// a cursor without associations is dropped, forcing a full sync for that url
+func loadAggregateCursors(store *CoreStores, aggregateURLs []string) map[string]string {
+	cursors := make(map[string]string)
+	metaStore, ok := store.durableMeta()
+	if !ok {
+		return cursors
+	}
+
+	for _, aggregateURL := range aggregateURLs {
+		jsSource, err := metaStore.GetMeta(aggregateSourceMeta + aggregateURL)
+		if err != nil || jsSource == nil {
+			continue
+		}
+		if err := store.sources.Restore(aggregateURL, jsSource); err != nil {
+			slog.Error("error loading sources for aggregate url", "url", aggregateURL, "error", err)
+			continue
+		}
+
+		cursor, err := metaStore.GetMeta(aggregateCursorMeta + aggregateURL)
+		if err != nil {
+			slog.Error("error loading cursor for aggregate url", "url", aggregateURL, "error", err)
+			continue
+		}
+		cursors[aggregateURL] = string(cursor)
+	}
+	return cursors
+}
+
+// saveAggregateSource persists reported associations followed by cursor in backup store,
+// so restarts continue incrementally
+func saveAggregateSource(store *CoreStores, aggregateURL, cursor string) {
+	metaStore, ok := store.durableMeta()
+	if !ok {
+		return
+	}
+
+	jsSource, err := store.sources.Serialize(aggregateURL)
+	if err == nil {
+		err = metaStore.SetMeta(aggregateSourceMeta+aggregateURL, jsSource)
+	}
+	if err != nil {
+		slog.Error("error saving sources for aggregate url", "url", aggregateURL, "error", err)
+		return
+	}
+
+	if err := metaStore.SetMeta(aggregateCursorMeta+aggregateURL, []byte(cursor)); err != nil {
+		slog.Error("error saving cursor for aggregate url", "url", aggregateURL, "error", err)
+	}
+}
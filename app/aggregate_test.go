@@ -0,0 +1,245 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+)
+
+func TestAggregateSyncBackoff(t *testing.T) {
+	syncer := &aggregateSync{interval: 1 * time.Second, maxBackoff: 10 * time.Second}
+
+	for failures := 1; failures < 100; failures++ {
+		expected := syncer.interval << uint(failures)
+		if failures > 16 || expected > syncer.maxBackoff {
+			expected = syncer.maxBackoff
+		}
+
+		backoff := syncer.backoff(failures)
+		if backoff < expected/2 || backoff > expected {
+			t.Errorf("Backoff %v for %d failures not within [%v, %v]", backoff, failures, expected/2, expected)
+			return
+		}
+	}
+}
+
+func TestAggregateSyncFailingURLs(t *testing.T) {
+	// hung peer never responds within sync timeout
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer hung.Close()
+
+	// failing peer returns an error body which should not be merged
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError(w, http.StatusInternalServerError, "failing")
+	}))
+	defer failing.Close()
+
+	buf1 := []byte(fmt.Sprintf(`
+Port : 8080
+Stores :
+- aggregate:
+    SyncInterval: 1
+    SyncTimeout: 1
+    SyncParallel: 2
+    SyncFailureThreshold: 1
+    Aggregate:
+    - %s/v1/store/local
+    - %s/v1/store/local
+    - http://127.0.0.1:8081/v1/store/local
+`, hung.URL, failing.URL))
+
+	buf2 := []byte(`
+Port : 8081
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config1.yml")
+	defer os.Remove("./config2.yml")
+	if err := ioutil.WriteFile("./config1.yml", buf1, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile("./config2.yml", buf2, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config1", "./config1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	ctx2, err := CreateContext("config2", "./config2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx2)
+
+	time.Sleep(1 * time.Second)
+
+	if err := postStore("http://127.0.0.1:8081/v1/store/local/update", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(3 * time.Second)
+
+	res, err := queryStoreKeys("http://127.0.0.1:8080/v1/store/aggregate/query", []byte(`{"num": "6.13"}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Log("Store returned", res, "Expect", []string{"m1"})
+
+	if len(res) != 1 || res[0] != "m1" {
+		t.Errorf("Expected healthy url to sync despite hung and failing urls, found %v", res)
+		return
+	}
+
+	var statuses []aggregateURLStatus
+	if err := getJSON("http://127.0.0.1:8080/v1/store/aggregate/sync", &statuses); err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Log("Sync status", statuses)
+
+	if len(statuses) != 3 {
+		t.Errorf("Expected status of 3 urls, found %d", len(statuses))
+		return
+	}
+
+	for _, status := range statuses {
+		if status.URL == "http://127.0.0.1:8081/v1/store/local" {
+			if status.LastSuccess == nil || status.ConsecutiveFailures != 0 || status.Degraded {
+				t.Errorf("Expected healthy url to be synced, found %+v", status)
+			}
+			continue
+		}
+		if status.LastError == "" || status.ConsecutiveFailures == 0 || !status.Degraded {
+			t.Errorf("Expected url %s to be failing and degraded, found %+v", status.URL, status)
+		}
+	}
+
+	var health map[string]interface{}
+	if err := getJSON("http://127.0.0.1:8080/v1/health", &health); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if health["status"] != "degraded" {
+		t.Errorf("Expected health to be degraded, found %v", health)
+	}
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d, expected success with 200, error: %s", url, resp.StatusCode, string(bodyBytes))
+	}
+
+	return json.Unmarshal(bodyBytes, v)
+}
+
+func postJSON(url string, buf []byte, v interface{}) error {
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d, expected success with 200, error: %s", url, resp.StatusCode, string(bodyBytes))
+	}
+
+	return json.Unmarshal(bodyBytes, v)
+}
+
+func TestAggregateSourceSavedPeriodically(t *testing.T) {
+	// remote store reports a new association on every pull of changes
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var seq int
+		fmt.Sscanf(r.URL.Query().Get("since"), "c%d", &seq)
+		response, _ := json.Marshal(changesResponse{
+			Cursor:  fmt.Sprintf("c%d", seq+1),
+			Changes: []core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: fmt.Sprintf("m%d", seq)}},
+		})
+		respondJSON(w, http.StatusOK, response)
+	}))
+	defer remote.Close()
+
+	primary, backup := &core.InMemoryStore{}, &core.InMemoryStore{}
+	core.InitializeStore(primary, nil)
+	core.InitializeStore(backup, nil)
+	store := &CoreStores{primary: primary, backup: backup, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+	remoteURL := remote.URL + "/v1/store/local"
+	syncer := newAggregateSync(store, Store{AggregateURLs: []string{remoteURL}, SyncIntervalSec: 1, SyncTimeoutSec: 1, SyncParallel: 1}, nil)
+	source := syncer.sources[0]
+	source.cursor, source.savedCursor = "c0", "c0"
+
+	savedCursor := func() string {
+		cursor, _ := backup.GetMeta(aggregateCursorMeta + remoteURL)
+		return string(cursor)
+	}
+
+	// first sync is saved, following syncs within the interval are not
+	for i, expected := range []string{"c1", "c1"} {
+		syncer.inflight.Add(1)
+		syncer.syncSource(source, source.cursor)
+		if source.lastError != nil {
+			t.Error(source.lastError)
+			return
+		}
+		if savedCursor() != expected {
+			t.Errorf("Expected cursor %s saved after sync %d, found %s", expected, i, savedCursor())
+		}
+	}
+
+	// stopping sync saves the latest cursor along with the associations
+	syncer.saveSources()
+	if savedCursor() != "c2" {
+		t.Errorf("Expected latest cursor saved once sync is stopped, found %s", savedCursor())
+	}
+	restored := core.NewSourceIndex()
+	jsSource, _ := backup.GetMeta(aggregateSourceMeta + remoteURL)
+	if err := restored.Restore(remoteURL, jsSource); err != nil {
+		t.Error(err)
+		return
+	}
+	if effective := restored.Apply(remoteURL, []core.Change{{Op: core.ChangeRemove, Property: "num:6.13", Key: "m1"}}); len(effective) != 1 {
+		t.Errorf("Expected association of unsaved sync saved, found %v", effective)
+	}
+}
@@ -2,12 +2,15 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"time"
+	"sync"
 )
 
 // APIVERSION current supported version
@@ -15,49 +18,126 @@ const APIVERSION string = "/v1"
 
 // Context stores local and aggregate stores
 type Context struct {
-	config    Config
-	stores    map[string]*CoreStores
-	appRoutes []Route
-	srv       *http.Server
+	config Config
+	// guards stores and config stores, which are created and dropped at runtime
+	storesLock sync.RWMutex
+	stores     map[string]*CoreStores
+	// stores being opened outside of storesLock, reserving their names and directories
+	pendingStores map[string]Store
+	appRoutes     []Route
+	// health and pprof, served by admin listener when configured
+	adminRoutes []Route
+	srv         *http.Server
+	adminSrv    *http.Server
+	// failures of listeners, returned by Execute, servers are waited for on delete
+	serveErrors chan error
+	serving     sync.WaitGroup
+	// closed on server shutdown to end long lived watch streams
+	watchDone chan struct{}
+	// log file closed on delete, nil when logging to stderr or stdout
+	logOutput io.Closer
+	// transport of aggregate sync and replication requests, nil uses default transport
+	syncTransport http.RoundTripper
+	limiters      *rateLimiters
+	logLevel      *slog.LevelVar
+	// configuration file found on create, reloads of it are serialized and watched until watchConfigDone is closed
+	configFile      string
+	reloadLock      sync.Mutex
+	watchConfigDone chan struct{}
+	watching        sync.WaitGroup
 }
 
 // Create App context creating router handling multiple REST API
 func (ctx *Context) Create() error {
+	var tlsConfig *tls.Config
+	if ctx.config.TLS.enabled() {
+		var err error
+		if tlsConfig, err = ctx.config.TLS.serverConfig(); err != nil {
+			return err
+		}
+	}
+	// listen before serving, so address in use is reported to the caller
+	listener, err := listen(ctx.config.Listen)
+	if err != nil {
+		return err
+	}
+	var adminListener net.Listener
+	if len(ctx.config.AdminListen) > 0 {
+		if adminListener, err = listen(ctx.config.AdminListen); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	ctx.limiters = newRateLimiters(&ctx.config)
 	// register default and app routes
 	ctx.registerRoutes()
-	appRouter := NewAppRouter(ctx)
-	ctx.srv = &http.Server{
-		Addr:         "127.0.0.1:" + ctx.config.Port,
-		Handler:      appRouter,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second}
-	go func() {
-		if err := ctx.srv.ListenAndServe(); err != nil {
-			if flag.Lookup("test.v") == nil {
-				log.Fatal(err)
-			} else {
-				log.Println(err)
-			}
-		}
-	}()
+	ctx.srv = ctx.newServer(NewAppRouter(ctx), tlsConfig)
+	metrics.stores.add(ctx)
+	ctx.watchDone = make(chan struct{})
+	ctx.srv.RegisterOnShutdown(func() { close(ctx.watchDone) })
+	// buffered for both listeners, so failing listener never blocks
+	ctx.serveErrors = make(chan error, 2)
+	ctx.serving.Add(1)
+	go ctx.serve(ctx.srv, listener)
+	if adminListener != nil {
+		// admin listener serves https as well when TLS is configured, profiling exposes server internals
+		ctx.adminSrv = ctx.newServer(NewAdminRouter(ctx), tlsConfig.Clone())
+		ctx.serving.Add(1)
+		go ctx.serve(ctx.adminSrv, adminListener)
+	}
+	ctx.warnOpenAccess()
 	return nil
 }
 
+// warnOpenAccess when a listener accepts remote clients without credentials configured
+func (ctx *Context) warnOpenAccess() {
+	if len(ctx.config.Auth) > 0 {
+		return
+	}
+	for _, address := range []string{ctx.config.Listen, ctx.config.AdminListen} {
+		if len(address) > 0 && !loopback(address) {
+			slog.Warn("listener accepts remote clients without Auth, every store could be read, changed and dropped", "listen", address)
+		}
+	}
+}
+
 // CreateContext creates and sets up context, stores and starts HTTP Server
 func CreateContext(configName, configDir string) (*Context, error) {
 	ctx := &Context{}
 	// Initialize configuration
-	if err := ctx.config.Initialize(configName, configDir); err != nil {
+	v, err := findConfig(configName, configDir)
+	if err != nil {
+		return nil, err
+	}
+	ctx.configFile = v.ConfigFileUsed()
+	if err := ctx.config.load(v); err != nil {
+		return nil, err
+	}
+	// Initialize logger of configured level and output
+	if err := ctx.initializeLogger(); err != nil {
+		return nil, err
+	}
+	// Initialize transport of requests to remote stores
+	if ctx.syncTransport, err = ctx.config.SyncTLS.transport(); err != nil {
+		ctx.closeLogger()
 		return nil, err
 	}
 	// Initialize any stores, primary and backup
 	if err := ctx.InitializeStores(); err != nil {
+		ctx.closeLogger()
 		return nil, err
 	}
 	// Create context
 	if err := ctx.Create(); err != nil {
+		ctx.ShutdownStores()
+		ctx.closeLogger()
 		return nil, err
 	}
+	// Reload configuration when configuration file is modified
+	ctx.watchConfigDone = make(chan struct{})
+	ctx.watching.Add(1)
+	go ctx.watchConfig(ctx.configFile, ctx.watchConfigDone)
 
 	return ctx, nil
 }
@@ -69,25 +149,58 @@ func CreateDefaultContext() (*Context, error) {
 
 // DeleteContext app context and HTTP Server
 func DeleteContext(ctx *Context) error {
+	// Stop watching configuration file, so stores are not reloaded while they are shutdown
+	if ctx.watchConfigDone != nil {
+		close(ctx.watchConfigDone)
+		ctx.watching.Wait()
+	}
 	// Shutdown HTTP server
 	// even if there is an error shutting down HTTP its ok to ignore
 	ctx.srv.Shutdown(context.TODO())
+	if ctx.adminSrv != nil {
+		ctx.adminSrv.Shutdown(context.TODO())
+	}
+	// listeners are closed once serving returns, so their addresses can be listened on again
+	ctx.serving.Wait()
+	metrics.stores.remove(ctx)
 	// Shutdown of all the stores
-	return ctx.ShutdownStores()
+	err := ctx.ShutdownStores()
+	ctx.closeLogger()
+	return err
 }
 
-func waitForCtrlC() {
+// waitForCtrlC or a failing listener, returning error of the listener
+func waitForCtrlC(serveErrors <-chan error) error {
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt)
-	<-sigc
+	select {
+	case <-sigc:
+		return nil
+	case err := <-serveErrors:
+		return err
+	}
 }
 
-// Execute starts application and waits for ctrl+c
+// Execute starts application and waits for ctrl+c, or until a listener fails
+// with --check-config only validates configuration file and exits
 func Execute() error {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	checkConfig := flags.Bool("check-config", false, "validate configuration file, reporting every problem, and exit")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	if *checkConfig {
+		return CheckConfig("config", "./config")
+	}
+
 	ctx, err := CreateDefaultContext()
 	if err != nil {
 		return err
 	}
-	waitForCtrlC()
-	return DeleteContext(ctx)
+	serveErr := waitForCtrlC(ctx.serveErrors)
+	err = DeleteContext(ctx)
+	if serveErr != nil {
+		return serveErr
+	}
+	return err
 }
@@ -3,11 +3,15 @@ package app
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
+
+	"github.com/awesomenix/keypropstore/core"
 )
 
 func testBasicUpdateQuery(buf []byte, t *testing.T) {
@@ -301,6 +305,39 @@ Stores :
 	testBasicUpdateQuery(buf, t)
 }
 
+func TestLevelDBUpdateQuery(t *testing.T) {
+
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+    Backup: LevelDB
+    BackupDir: ./leveldbtest
+    BackupOptions:
+      SyncWrites: true
+`)
+
+	defer os.RemoveAll("./leveldbtest")
+	testBasicUpdateQuery(buf, t)
+}
+
+func TestTieredPrimaryUpdateQuery(t *testing.T) {
+
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+    Backup: LevelDB
+    BackupDir: ./tieredtest
+    PrimaryCache: 1
+`)
+
+	defer os.RemoveAll("./tieredtest")
+	testBasicUpdateQuery(buf, t)
+	// restarted tiered store reads through from backup store
+	testNoUpdateQuery(buf, t)
+}
+
 func TestBadgerDBBackup(t *testing.T) {
 
 	buf := []byte(`
@@ -410,3 +447,312 @@ Stores :
 	defer os.RemoveAll("./boltdbtest")
 	testBasicAggregateQuery(buf1, buf2, t)
 }
+
+func postStore(url string, buf []byte) error {
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d, expected success with 200, error: %s", url, resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+func queryStoreKeys(url string, query []byte) ([]string, error) {
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned %d, expected success with 200, error: %s", url, resp.StatusCode, string(bodyBytes))
+	}
+
+	var res []string
+	err = json.Unmarshal(bodyBytes, &res)
+	return res, err
+}
+
+func TestAggregateIncrementalRemove(t *testing.T) {
+	buf1 := []byte(`
+Port : 8080
+Stores :
+- aggregate:
+    SyncInterval: 1
+    Aggregate:
+    - http://127.0.0.1:8081/v1/store/local
+`)
+
+	buf2 := []byte(`
+Port : 8081
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config1.yml")
+	defer os.Remove("./config2.yml")
+	if err := ioutil.WriteFile("./config1.yml", buf1, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile("./config2.yml", buf2, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config1", "./config1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	ctx2, err := CreateContext("config2", "./config2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx2)
+
+	time.Sleep(1 * time.Second)
+
+	if err := postStore("http://127.0.0.1:8081/v1/store/local/update", []byte(`{"m1": {"num": "6.13"}, "m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(3 * time.Second)
+
+	if err := postStore("http://127.0.0.1:8081/v1/store/local/remove", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(2 * time.Second)
+
+	res, err := queryStoreKeys("http://127.0.0.1:8080/v1/store/aggregate/query", []byte(`{"num": "6.13"}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Log("Store returned", res, "Expect", []string{"m2"})
+
+	if len(res) != 1 || res[0] != "m2" {
+		t.Errorf("Expected removal of m1 to propagate to aggregate, found %v", res)
+	}
+}
+
+func TestAggregateReconcileSources(t *testing.T) {
+	buf1 := []byte(`
+Port : 8080
+Stores :
+- aggregate:
+    SyncInterval: 1
+    Aggregate:
+    - http://127.0.0.1:8081/v1/store/local
+    - http://127.0.0.1:8082/v1/store/local
+`)
+
+	buf2 := []byte(`
+Port : 8081
+Stores :
+- local:
+`)
+
+	buf3 := []byte(`
+Port : 8082
+Stores :
+- local:
+`)
+
+	for fileName, buf := range map[string][]byte{"./config1.yml": buf1, "./config2.yml": buf2, "./config3.yml": buf3} {
+		defer os.Remove(fileName)
+		if err := ioutil.WriteFile(fileName, buf, 0644); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	ctx, err := CreateContext("config1", "./config1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	ctx2, err := CreateContext("config2", "./config2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx3, err := CreateContext("config3", "./config3")
+	if err != nil {
+		DeleteContext(ctx2)
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx3)
+
+	time.Sleep(1 * time.Second)
+
+	if err := postStore("http://127.0.0.1:8081/v1/store/local/update", []byte(`{"m1": {"num": "6.13"}, "m2": {"num": "6.13"}, "m3": {"num": "6.13"}}`)); err != nil {
+		DeleteContext(ctx2)
+		t.Error(err)
+		return
+	}
+
+	if err := postStore("http://127.0.0.1:8082/v1/store/local/update", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		DeleteContext(ctx2)
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(3 * time.Second)
+
+	// restart region on 8081 with only m2, cursor becomes invalid and aggregate performs full sync
+	DeleteContext(ctx2)
+	ctx2, err = CreateContext("config2", "./config2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx2)
+
+	time.Sleep(1 * time.Second)
+
+	if err := postStore("http://127.0.0.1:8081/v1/store/local/update", []byte(`{"m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(3 * time.Second)
+
+	res, err := queryStoreKeys("http://127.0.0.1:8080/v1/store/aggregate/query", []byte(`{"num": "6.13"}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Log("Store returned", res, "Expect", []string{"m1", "m2"})
+
+	if len(res) != 2 {
+		t.Errorf("Expected m3 to be removed and m1 kept from other source, found %v", res)
+		return
+	}
+	for _, key := range res {
+		if key != "m1" && key != "m2" {
+			t.Errorf("Expected m1 and m2, found %v", res)
+		}
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	const storeURL string = "http://127.0.0.1:8080/v1/store/local"
+	if err := postStore(storeURL+"/update", []byte(`{"m1": {"num": "6.13", "strs": "a"}, "m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var usage core.InMemoryStoreUsage
+	if err := getJSON(storeURL+"/memory", &usage); err != nil {
+		t.Error(err)
+		return
+	}
+	if usage.Properties != 2 || usage.Keys != 2 || usage.Associations != 3 {
+		t.Errorf("Expected 2 properties, 2 keys and 3 associations, found %+v", usage)
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+    Backup : LevelDB
+    BackupDir : ./statstest
+    BackupWriteBehind : true
+`)
+
+	os.RemoveAll("./statstest")
+	defer os.RemoveAll("./statstest")
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	const storeURL string = "http://127.0.0.1:8080/v1/store/local"
+	if err := postStore(storeURL+"/update", []byte(`{"m1": {"num": "6.13", "strs": "a"}, "m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var stats storeStats
+	if err := getJSON(storeURL+"/stats?largest=1", &stats); err != nil {
+		t.Error(err)
+		return
+	}
+	if stats.Backend != "InMemory" || stats.Backup != "LevelDB" || stats.Properties != 2 || stats.Keys != 2 || stats.Associations != 3 {
+		t.Errorf("Expected 2 properties, 2 keys and 3 associations of InMemory store backed by LevelDB, found %+v", stats)
+	}
+	if len(stats.Largest) != 1 || stats.Largest[0].Property != "num:6.13" || stats.Largest[0].Keys != 2 {
+		t.Errorf("Expected num:6.13 largest posting list, found %+v", stats.Largest)
+	}
+	if stats.DiskBytes <= 0 {
+		t.Errorf("Expected disk size of backup store, found %d", stats.DiskBytes)
+	}
+
+	if err := getJSON(storeURL+"/stats?largest=all", &stats); err == nil {
+		t.Errorf("Expected invalid largest to be rejected")
+	}
+}
+
+func TestHealthCheckHandlerWithoutContext(t *testing.T) {
+	// routers registering the package handler keep working without a context
+	recorder := httptest.NewRecorder()
+	HealthCheckHandler(recorder, httptest.NewRequest("GET", "/v1/health", nil), nil)
+	if recorder.Code != http.StatusOK || !bytes.Contains(recorder.Body.Bytes(), []byte(`"message":"ok"`)) {
+		t.Errorf("Expected health ok, found %d %s", recorder.Code, recorder.Body.String())
+	}
+}
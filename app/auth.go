@@ -0,0 +1,130 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// scopes granted to credentials per store, checked against scope of each route
+const (
+	// scopeNone routes are served without credentials
+	scopeNone    string = ""
+	scopeQuery   string = "query"
+	scopeUpdate  string = "update"
+	scopeBackup  string = "backup"
+	scopeRestore string = "restore"
+	// scopeAdmin grants every other scope of the store
+	scopeAdmin string = "admin"
+)
+
+// allStores scopes granted on every store, also required by routes without a store
+const allStores string = "*"
+
+var scopes = []string{scopeQuery, scopeUpdate, scopeBackup, scopeRestore, scopeAdmin}
+
+// Credential bearer token or api key granted scopes per store
+type Credential struct {
+	Name   string
+	Token  string
+	Scopes map[string][]string
+}
+
+// validScope one of query, update, backup, restore or admin
+func validScope(scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allows scope on store, either granted on the store or on all stores
+func (c *Credential) allows(storeName, scope string) bool {
+	for _, name := range []string{storeName, allStores} {
+		for _, granted := range c.Scopes[name] {
+			if granted == scope || granted == scopeAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestToken from Authorization bearer token or X-API-Key header
+func requestToken(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authenticate finds credential of token, comparing hashes in constant time against every credential
+func authenticate(credentials []Credential, token string) (*Credential, bool) {
+	if len(token) == 0 {
+		return nil, false
+	}
+	hash := sha256.Sum256([]byte(token))
+	var found *Credential
+	for i := range credentials {
+		credentialHash := sha256.Sum256([]byte(credentials[i].Token))
+		if subtle.ConstantTimeCompare(hash[:], credentialHash[:]) == 1 && found == nil {
+			found = &credentials[i]
+		}
+	}
+	return found, found != nil
+}
+
+// setAuthorization presents token to remote stores as bearer token
+func setAuthorization(r *http.Request, token string) {
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// credentials configured, replaced when configuration is reloaded
+func (ctx *Context) credentials() []Credential {
+	ctx.storesLock.RLock()
+	defer ctx.storesLock.RUnlock()
+	return ctx.config.Auth
+}
+
+// AuthMiddleware Handler requiring credentials granted scope on store of the request
+// routes without a store require scope on all stores, every route is served when no credentials are configured
+func (ctx *Context) AuthMiddleware(scope string, next httprouter.Handle) httprouter.Handle {
+	if scope == scopeNone {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		credentials := ctx.credentials()
+		if len(credentials) == 0 {
+			next(w, r, ps)
+			return
+		}
+
+		credential, ok := authenticate(credentials, requestToken(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="keypropstore"`)
+			respondWithError(w, http.StatusUnauthorized, "missing or invalid credentials")
+			return
+		}
+		if recorder, ok := w.(*responseRecorder); ok {
+			recorder.client = credential.Name
+		}
+
+		storeName := ps.ByName("store")
+		if len(storeName) == 0 {
+			storeName = allStores
+		}
+		if !credential.allows(storeName, scope) {
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("credential %s is not granted %s on store %s", credential.Name, scope, storeName))
+			return
+		}
+		next(w, r, ps)
+	}
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// authRequest sends request presenting token as bearer token, returning status and body
+func authRequest(method, url, token string, buf []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(buf))
+	if err != nil {
+		return 0, nil, err
+	}
+	setAuthorization(req, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+func TestAuth(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Auth :
+  - Name : reader
+    Token : reader-token
+    Scopes :
+      local : [query]
+  - Name : aggregator
+    Token : aggregator-token
+    Scopes :
+      local : [backup]
+  - Name : operator
+    Token : operator-token
+    Scopes :
+      "*" : [admin]
+Stores :
+- local:
+- aggregate:
+    SyncInterval : 1
+    SyncToken : aggregator-token
+    Aggregate:
+      - http://127.0.0.1:8080/v1/store/local
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	const baseURL string = "http://127.0.0.1:8080/v1"
+	update := []byte(`{"m1": {"num": "6.13"}}`)
+	query := []byte(`{"num": "6.13"}`)
+	for _, test := range []struct {
+		method   string
+		uri      string
+		token    string
+		body     []byte
+		expected int
+	}{
+		{"GET", "/health", "", nil, http.StatusOK},
+		{"POST", "/store/local/update", "", update, http.StatusUnauthorized},
+		{"POST", "/store/local/update", "invalid-token", update, http.StatusUnauthorized},
+		{"POST", "/store/local/update", "reader-token", update, http.StatusForbidden},
+		{"POST", "/store/local/update", "operator-token", update, http.StatusOK},
+		{"POST", "/store/local/query", "reader-token", query, http.StatusOK},
+		{"POST", "/store/aggregate/query", "reader-token", query, http.StatusForbidden},
+		{"GET", "/store/local/backup", "reader-token", nil, http.StatusForbidden},
+		{"GET", "/store/local/backup", "aggregator-token", nil, http.StatusOK},
+		{"POST", "/store/local/restore", "aggregator-token", []byte(`{}`), http.StatusForbidden},
+		{"GET", "/stores", "reader-token", nil, http.StatusForbidden},
+		{"GET", "/stores", "operator-token", nil, http.StatusOK},
+		{"GET", "/debug/pprof/cmdline", "", nil, http.StatusUnauthorized},
+	} {
+		status, body, err := authRequest(test.method, baseURL+test.uri, test.token, test.body)
+		if err != nil || status != test.expected {
+			t.Errorf("Expected %s %s with token %q to return %d, found %d %s, %v", test.method, test.uri, test.token, test.expected, status, string(body), err)
+		}
+	}
+
+	// api key header is accepted as well
+	req, _ := http.NewRequest("POST", baseURL+"/store/local/query", bytes.NewBuffer(query))
+	req.Header.Set("X-API-Key", "reader-token")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected api key accepted, found %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// aggregate store presents its sync token to the local store
+	time.Sleep(2 * time.Second)
+	status, body, err := authRequest("POST", baseURL+"/store/aggregate/query", "operator-token", query)
+	var keys []string
+	if err == nil {
+		err = json.Unmarshal(body, &keys)
+	}
+	if err != nil || status != http.StatusOK || len(keys) != 1 || keys[0] != "m1" {
+		t.Errorf("Expected aggregate store synced with credentials, found %d %s, %v", status, string(body), err)
+	}
+}
@@ -1,103 +1,513 @@
 package app
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/awesomenix/keypropstore/core"
 	"github.com/spf13/viper"
 )
 
 // Store details for this application
-// primary store is always inmemory with
-// optional backup store along with backup directory
+// primary store is inmemory with optional backup store along with backup directory
+// or tiered, caching hot properties in memory and reading the rest from the backup store
 // also aggregte urls for aggregating multiple stores into the primary
 type Store struct {
-	Name            string
-	Backup          string
-	Backupdir       string
-	AggregateURLs   []string
-	SyncIntervalSec int
+	Name      string
+	Backup    string
+	Backupdir string
+	// backend specific settings, decoded by the registered backend
+	BackupOptions     map[string]interface{}
+	AggregateURLs     []string
+	SyncIntervalSec   int
+	SyncTimeoutSec    int
+	SyncParallel      int
+	SyncMaxBackoffSec int
+	// aggregate url failing longer than threshold reports health as degraded
+	SyncFailureThresholdSec int
+	ChangeLogSize           int
+	// downstream stores pushed committed changes
+	ReplicateURLs      []string
+	ReplicateSource    string
+	ReplicateBatchSize int
+	ReplicateQueueSize int
+	// credentials presented to aggregate urls and replicate urls
+	SyncToken      string
+	ReplicateToken string
+	// primary store hashes properties to shards with separate locks, 0 uses a single lock
+	Shards int
+	// memory budget of tiered primary store over backup store, 0 keeps complete store in memory
+	PrimaryCacheMB int
+	// optional write ahead log directory making the primary store durable without a backup store
+	WALDir                string
+	WALSync               string
+	WALSyncIntervalSec    int
+	WALCompactThreshold   int
+	WALCompactIntervalSec int
+	// optionally apply changes to backup store asynchronously in batches
+	BackupWriteBehind bool
+	BackupQueueSize   int
+	BackupBatchSize   int
+	// periodic snapshots of primary store to BackupDir, 0 interval disables them and restoring on startup
+	SnapshotIntervalMin int
+	SnapshotRetain      int
+	// created through store management api and persisted to StoresFile rather than configuration file
+	Runtime bool
 }
 
 // Config context for this application
 type Config struct {
-	Port   string
-	Stores []Store
+	Port string
+	// address of the listener, host:port, [ipv6]:port or unix:/path/to/socket, defaults to 127.0.0.1:Port
+	Listen string
+	// optional listener serving health and pprof, which are then no longer served by Listen
+	AdminListen     string
+	ReadTimeoutSec  int
+	WriteTimeoutSec int
+	IdleTimeoutSec  int
+	// limit of request bodies, restore and replicate requests carrying complete stores are limited by MaxRestoreBodyMB
+	MaxBodyMB        int
+	MaxRestoreBodyMB int
+	// requests per client by route class, which is the scope of the route, and concurrent backup and restore requests, 0 is unlimited
+	RateLimits           map[string]RateLimit
+	MaxConcurrentBackups int
+	Stores               []Store
+	// stores created at runtime, defaults to stores.json next to configuration file
+	StoresFile string
+	// directories of stores created at runtime are confined below RuntimeDataDir, default working directory
+	RuntimeDataDir string
+	// json logs of at least LogLevel, debug, info, warn or error, written to stderr, stdout or a file path
+	LogLevel  string
+	LogOutput string
+	// credentials granted scopes per store, every request is served when empty
+	Auth []Credential
+	// listener serves https when certificate is configured, SyncTLS applies to requests to remote stores
+	TLS     TLSConfig
+	SyncTLS ClientTLSConfig
 }
 
 // Config will look like this
 // Port : 8080
+// Listen : "[::1]:8080"
+// AdminListen : 127.0.0.1:9090
+// ReadTimeout : 10
+// WriteTimeout : 10
+// IdleTimeout : 60
+// MaxBodyMB : 16
+// MaxRestoreBodyMB : 1024
+// RateLimits :
+//   update :
+//     Rate : 100
+//     Burst : 200
+// MaxConcurrentBackups : 2
+// StoresFile : ./config/stores.json
+// RuntimeDataDir : ./data
+// LogLevel : info
+// LogOutput : stderr
+// Auth :
+//   - Name : aggregator
+//     Token : secret
+//     Scopes :
+//       Machines : [query, backup]
+//       "*" : [query]
+// TLS :
+//   CertFile : ./certs/server.pem
+//   KeyFile : ./certs/server-key.pem
+//   ClientCAFile : ./certs/ca.pem
+// SyncTLS :
+//   CAFile : ./certs/ca.pem
+//   CertFile : ./certs/client.pem
+//   KeyFile : ./certs/client-key.pem
 // Stores :
 //   - Machines :
 //	     Backup : BoltDB
-//       BackupDir : ./boltdb
+//       BackupDir : ./boltdb/machines
+//       BackupOptions :
+//         TimeoutSec : 5
+//       BackupWriteBehind : true
+//       BackupQueueSize : 100000
+//       BackupBatchSize : 1000
+//       WAL : ./wal/machines
+//       WALSync : interval
+//       WALSyncInterval : 1
+//       WALCompactThreshold : 100000
+//       WALCompactInterval : 600
+//       SnapshotInterval : 60
+//       SnapshotRetain : 5
+//       ReplicateSource : http://127.0.0.1:8080/v1/store/Machines
+//       ReplicateBatchSize : 1000
+//       ReplicateQueueSize : 100000
+//       ReplicateToken : secret
+//       Replicate:
+//			- URL1
+//   - Inventory :
+//	     Backup : BoltDB
+//       BackupDir : ./boltdb/inventory
+//       PrimaryCache : 512
 //   - GlobalAggregateMachines :
 //	     Backup : BoltDB
-//       BackupDir : ./boltdb
+//       BackupDir : ./boltdb/aggregate
+//       Shards : 32
 //       SyncInterval : 10
+//       SyncTimeout : 10
+//       SyncParallel : 4
+//       SyncMaxBackoff : 300
+//       SyncFailureThreshold : 300
+//       ChangeLogSize : 100000
+//       SyncToken : secret
 //		 Aggregate:
 //			- URL1
 //			- URL2
 //			...
 
+// defaultStore settings of store name, overridden by configured settings
+func (cfg *Config) defaultStore(name string) Store {
+	var store Store
+
+	store.Name = name
+	// Default sync interval is 10 seconds from aggregate urls
+	store.SyncIntervalSec = 10
+	// Default timeout for each request to aggregate urls
+	store.SyncTimeoutSec = 10
+	// Default number of aggregate urls fetched in parallel
+	store.SyncParallel = 4
+	// Default maximum backoff for failing aggregate urls is 5 minutes
+	store.SyncMaxBackoffSec = 300
+	// Default health is degraded after an aggregate url fails for 5 minutes
+	store.SyncFailureThresholdSec = 300
+	// Default number of changes retained for incremental sync by remote aggregates
+	store.ChangeLogSize = defaultChangeLogSize
+	store.ReplicateBatchSize = 1000
+	store.ReplicateQueueSize = 100000
+	// Default write ahead log is fsynced every second and compacted every 100000 changes or 10 minutes
+	store.WALSync = core.WALSyncInterval
+	store.WALSyncIntervalSec = 1
+	store.WALCompactThreshold = 100000
+	store.WALCompactIntervalSec = 600
+	// Default write behind queue holds 100000 changes applied 1000 at a time
+	store.BackupQueueSize = 100000
+	store.BackupBatchSize = 1000
+	// Default keeps the newest 5 snapshots, periodic snapshots are disabled unless interval is set
+	store.SnapshotRetain = 5
+	return store
+}
+
 // Initialize AppConfig with sample yaml file provided above
 func (cfg *Config) Initialize(name, dir string) error {
-	viper.SetConfigName(name) // name of config file (without extension)
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(dir) // path to look for the config file in
-	viper.AddConfigPath(".") // optionally look for config in the working directory
-
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
+	v, err := findConfig(name, dir)
+	if err != nil { // Handle errors reading the config file
 		return err
 	}
 
-	viper.SetDefault("Port", "8080")
-	cfg.Port = viper.GetString("Port")
+	return cfg.load(v)
+}
+
+// findConfig reads configuration file name in dir or the working directory
+// every context reads its own viper, so contexts of different configuration files don't share settings
+func findConfig(name, dir string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigName(name) // name of config file (without extension)
+	v.SetConfigType("yaml")
+	v.AddConfigPath(dir) // path to look for the config file in
+	v.AddConfigPath(".") // optionally look for config in the working directory
 
-	stores := viper.Get("Stores")
-	for _, istorevalues := range stores.([]interface{}) {
-		for storename, istoresettings := range istorevalues.(map[interface{}]interface{}) {
-			var store Store
+	return v, v.ReadInConfig()
+}
 
-			store.Name = storename.(string)
-			// Default sync interval is 10 seconds from aggregate urls
-			store.SyncIntervalSec = 10
-			if istoresettings != nil {
-				setting := istoresettings.(map[interface{}]interface{})
-				if backup, ok := setting["Backup"]; ok {
-					store.Backup = backup.(string)
-				}
+// readConfigFile reads configuration file at path, found by findConfig when context was created
+func readConfigFile(file string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+
+	return v, v.ReadInConfig()
+}
 
-				if backupdir, ok := setting["BackupDir"]; ok {
-					store.Backupdir = backupdir.(string)
-				}
+// fields of configuration file by key, Port is decoded separately as either integer or string
+func (cfg *Config) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"Listen":               &cfg.Listen,
+		"AdminListen":          &cfg.AdminListen,
+		"ReadTimeout":          &cfg.ReadTimeoutSec,
+		"WriteTimeout":         &cfg.WriteTimeoutSec,
+		"IdleTimeout":          &cfg.IdleTimeoutSec,
+		"MaxBodyMB":            &cfg.MaxBodyMB,
+		"MaxRestoreBodyMB":     &cfg.MaxRestoreBodyMB,
+		"RateLimits":           &cfg.RateLimits,
+		"MaxConcurrentBackups": &cfg.MaxConcurrentBackups,
+		"Stores":               &cfg.Stores,
+		"StoresFile":           &cfg.StoresFile,
+		"RuntimeDataDir":       &cfg.RuntimeDataDir,
+		"LogLevel":             &cfg.LogLevel,
+		"LogOutput":            &cfg.LogOutput,
+		"Auth":                 &cfg.Auth,
+		"TLS":                  &cfg.TLS,
+		"SyncTLS":              &cfg.SyncTLS,
+	}
+}
 
-				if backupdir, ok := setting["SyncInterval"]; ok {
-					store.SyncIntervalSec = backupdir.(int)
-				}
+// fields of store settings in configuration file by key
+func (store *Store) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"Backup":               &store.Backup,
+		"BackupDir":            &store.Backupdir,
+		"BackupOptions":        &store.BackupOptions,
+		"BackupWriteBehind":    &store.BackupWriteBehind,
+		"BackupQueueSize":      &store.BackupQueueSize,
+		"BackupBatchSize":      &store.BackupBatchSize,
+		"Aggregate":            &store.AggregateURLs,
+		"SyncInterval":         &store.SyncIntervalSec,
+		"SyncTimeout":          &store.SyncTimeoutSec,
+		"SyncParallel":         &store.SyncParallel,
+		"SyncMaxBackoff":       &store.SyncMaxBackoffSec,
+		"SyncFailureThreshold": &store.SyncFailureThresholdSec,
+		"SyncToken":            &store.SyncToken,
+		"ChangeLogSize":        &store.ChangeLogSize,
+		"Replicate":            &store.ReplicateURLs,
+		"ReplicateSource":      &store.ReplicateSource,
+		"ReplicateBatchSize":   &store.ReplicateBatchSize,
+		"ReplicateQueueSize":   &store.ReplicateQueueSize,
+		"ReplicateToken":       &store.ReplicateToken,
+		"Shards":               &store.Shards,
+		"PrimaryCache":         &store.PrimaryCacheMB,
+		"WAL":                  &store.WALDir,
+		"WALSync":              &store.WALSync,
+		"WALSyncInterval":      &store.WALSyncIntervalSec,
+		"WALCompactThreshold":  &store.WALCompactThreshold,
+		"WALCompactInterval":   &store.WALCompactIntervalSec,
+		"SnapshotInterval":     &store.SnapshotIntervalMin,
+		"SnapshotRetain":       &store.SnapshotRetain,
+	}
+}
 
-				if aggregate, ok := setting["Aggregate"]; ok {
-					for _, aggregateURL := range aggregate.([]interface{}) {
-						store.AggregateURLs = append(store.AggregateURLs, aggregateURL.(string))
-					}
-				}
-			}
+// load AppConfig from configuration file read by v, along with stores created at runtime
+// every problem found is reported with the path of the setting, rather than only the first one
+func (cfg *Config) load(v *viper.Viper) error {
+	cfg.Port = "8080"
+	cfg.ReadTimeoutSec = 10
+	cfg.WriteTimeoutSec = 10
+	cfg.IdleTimeoutSec = 60
+	cfg.MaxBodyMB = 16
+	cfg.MaxRestoreBodyMB = 1024
+	cfg.RateLimits = make(map[string]RateLimit)
+	cfg.RuntimeDataDir = "."
+	cfg.LogLevel = "info"
+	cfg.LogOutput = "stderr"
 
-			cfg.Stores = append(cfg.Stores, store)
+	d := newConfigDecoder(cfg)
+	settings := configKeys(v)
+	for key, value := range settings {
+		if strings.EqualFold(key, "Port") {
+			cfg.Port = d.port("Port", value)
+			delete(settings, key)
 		}
+	}
+	d.fields("", settings, cfg.fields())
 
+	if !v.IsSet("Stores") {
+		d.errorf("Stores", "required, expected list of stores")
+	}
+	if len(cfg.Listen) == 0 {
+		cfg.Listen = "127.0.0.1:" + cfg.Port
+	}
+	d.validateListen("Listen", cfg.Listen)
+	if len(cfg.AdminListen) > 0 {
+		d.validateListen("AdminListen", cfg.AdminListen)
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		d.errorf("LogLevel", "%v", err)
+	}
+	if err := cfg.TLS.validate(); err != nil {
+		d.errors = append(d.errors, err.Error())
+	}
+	if err := cfg.SyncTLS.validate(); err != nil {
+		d.errors = append(d.errors, err.Error())
+	}
+	if len(cfg.StoresFile) == 0 {
+		cfg.StoresFile = filepath.Join(filepath.Dir(v.ConfigFileUsed()), "stores.json")
+	}
+	if err := cfg.loadRuntimeStores(); err != nil {
+		d.errors = append(d.errors, err.Error())
+	}
+	d.validateStoreDirs(cfg.Stores)
+	return d.err()
+}
+
+// loadRuntimeStores appends stores created at runtime, persisted to StoresFile
+func (cfg *Config) loadRuntimeStores() error {
+	jsStores, err := ioutil.ReadFile(cfg.StoresFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
+	var stores []json.RawMessage
+	if err := json.Unmarshal(jsStores, &stores); err != nil {
+		return fmt.Errorf("invalid stores file %s: %v", cfg.StoresFile, err)
+	}
+
+	for _, jsStore := range stores {
+		store, err := cfg.decodeStore(jsStore)
+		if err != nil {
+			return fmt.Errorf("invalid stores file %s: %v", cfg.StoresFile, err)
+		}
+		if _, ok := cfg.findStore(store.Name); ok {
+			return fmt.Errorf("invalid stores file %s: store %s is already configured", cfg.StoresFile, store.Name)
+		}
+		cfg.Stores = append(cfg.Stores, store)
+	}
 	return nil
 }
 
+// saveRuntimeStores persists stores created at runtime to StoresFile
+func (cfg *Config) saveRuntimeStores() error {
+	stores := make([]Store, 0)
+	for _, store := range cfg.Stores {
+		if store.Runtime {
+			stores = append(stores, store)
+		}
+	}
+
+	jsStores, err := json.MarshalIndent(stores, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// written to a temporary file and renamed, so the file is never partially written
+	tmpFile := cfg.StoresFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, jsStores, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, cfg.StoresFile)
+}
+
+// decodeStore settings of store created at runtime, missing settings are defaulted
+func (cfg *Config) decodeStore(jsStore []byte) (Store, error) {
+	store := cfg.defaultStore("")
+
+	decoder := json.NewDecoder(bytes.NewReader(jsStore))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&store); err != nil {
+		return store, err
+	}
+
+	if !validStoreName(store.Name) {
+		return store, fmt.Errorf("invalid store name %q, expected letters, digits, '-', '_' or '.'", store.Name)
+	}
+	if len(store.ReplicateURLs) > 0 && len(store.ReplicateSource) == 0 {
+		return store, fmt.Errorf("store %s: ReplicateSource is required with Replicate", store.Name)
+	}
+	if store.SyncTimeoutSec <= 0 || store.SyncMaxBackoffSec <= 0 {
+		return store, fmt.Errorf("store %s: SyncTimeoutSec and SyncMaxBackoffSec must be greater than 0", store.Name)
+	}
+	if len(store.Backup) > 0 {
+		if !core.IsBackend(store.Backup) {
+			return store, fmt.Errorf("Unknown backend %s for store %s, available backends %v", store.Backup, store.Name, core.Backends())
+		}
+		if !core.IsDurableBackend(store.Backup) {
+			return store, fmt.Errorf("store %s: backend %s keeps the store only in memory, expected durable backend", store.Name, store.Backup)
+		}
+		if len(store.Backupdir) == 0 {
+			return store, fmt.Errorf("store %s: Backupdir is required with Backup", store.Name)
+		}
+	}
+	// directories are removed when the store is dropped
+	for _, dir := range []string{store.Backupdir, store.WALDir} {
+		if len(dir) > 0 && !belowDir(cfg.RuntimeDataDir, dir) {
+			return store, fmt.Errorf("store %s: directory %s must be a subdirectory of %s", store.Name, dir, cfg.RuntimeDataDir)
+		}
+	}
+	store.Runtime = true
+	return store, nil
+}
+
+// findStore index of store name
+func (cfg *Config) findStore(name string) (int, bool) {
+	for i, store := range cfg.Stores {
+		if store.Name == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// belowDir reports whether dir is a subdirectory of root, compared as absolute paths
+func belowDir(root, dir string) bool {
+	return nestedDir(root, dir) && absDir(root) != absDir(dir)
+}
+
+// absDir absolute path of dir, so relative and absolute paths of the same directory compare equal
+func absDir(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return filepath.Clean(dir)
+	}
+	return abs
+}
+
+// emptyDir reports whether dir does not exist yet or holds no files
+func emptyDir(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && len(entries) == 0
+}
+
+// validStoreName is non empty and safe to use in urls and file names
+func validStoreName(name string) bool {
+	if len(name) == 0 || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// stringKeys converts yaml maps to string keyed maps, so they could be encoded as JSON
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = stringKeys(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stringKeys(item)
+		}
+	}
+	return value
+}
+
 // Log AppConfig mainly used for debugging purposes
 func (cfg *Config) Log() {
 	fmt.Println("Port:", cfg.Port)
 
 	for _, store := range cfg.Stores {
 		fmt.Println("Name:", store.Name)
-		fmt.Println("Primary: InMemoryStore")
+		if store.Shards > 0 {
+			fmt.Println("Primary: ShardedInMemoryStore", store.Shards)
+		} else if store.PrimaryCacheMB > 0 {
+			fmt.Println("Primary: TieredStore", store.PrimaryCacheMB, "MB")
+		} else {
+			fmt.Println("Primary: InMemoryStore")
+		}
+
+		if len(store.WALDir) > 0 {
+			fmt.Println("\tWAL:", store.WALDir)
+		}
 
 		if len(store.Backup) > 0 {
 			fmt.Println("\tBackup:", store.Backup)
@@ -105,9 +515,16 @@ func (cfg *Config) Log() {
 		if len(store.Backupdir) > 0 {
 			fmt.Println("\tBackupDir:", store.Backupdir)
 		}
+		if store.BackupWriteBehind {
+			fmt.Println("\tBackupWriteBehind:", store.BackupQueueSize)
+		}
 
 		if store.AggregateURLs != nil {
 			fmt.Println("\tAggregate:", store.AggregateURLs)
 		}
+
+		if store.ReplicateURLs != nil {
+			fmt.Println("\tReplicate:", store.ReplicateURLs)
+		}
 	}
 }
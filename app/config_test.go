@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -75,7 +76,7 @@ Stores :
 
 	stores[0].Name = "local"
 
-	expectedCfg := &Config{"8080", stores}
+	expectedCfg := &Config{Port: "8080", Stores: stores}
 
 	err = compareWithExpected(cfg, expectedCfg)
 	if err != nil {
@@ -118,7 +119,7 @@ Stores :
 	stores[1].Name = "second"
 	stores[2].Name = "third"
 
-	expectedCfg := &Config{"8080", stores}
+	expectedCfg := &Config{Port: "8080", Stores: stores}
 
 	err = compareWithExpected(cfg, expectedCfg)
 	if err != nil {
@@ -138,16 +139,16 @@ Port : 8080
 Stores :
 - local:
     Backup: BoltDB
-    BackupDir: ./boltdb
+    BackupDir: ./boltdb/local
 - second:
     Backup: BoltDB
-    BackupDir: ./boltdb
+    BackupDir: ./boltdb/second
 - third:
     Backup: BoltDB
-    BackupDir: ./boltdb
+    BackupDir: ./boltdb/third
     Aggregate:
-        - URL1
-        - URL2
+        - http://127.0.0.1:8081/v1/store/local
+        - http://127.0.0.1:8082/v1/store/local
 `)
 	err := ioutil.WriteFile(fileName, buf, 0644)
 	defer os.Remove(fileName)
@@ -168,16 +169,16 @@ Stores :
 
 	stores[0].Name = "local"
 	stores[0].Backup = "BoltDB"
-	stores[0].Backupdir = "./boltdb"
+	stores[0].Backupdir = "./boltdb/local"
 	stores[1].Name = "second"
 	stores[1].Backup = "BoltDB"
-	stores[1].Backupdir = "./boltdb"
+	stores[1].Backupdir = "./boltdb/second"
 	stores[2].Name = "third"
 	stores[2].Backup = "BoltDB"
-	stores[2].Backupdir = "./boltdb"
-	stores[2].AggregateURLs = []string{"URL1", "URL2"}
+	stores[2].Backupdir = "./boltdb/third"
+	stores[2].AggregateURLs = []string{"http://127.0.0.1:8081/v1/store/local", "http://127.0.0.1:8082/v1/store/local"}
 
-	expectedCfg := &Config{"8080", stores}
+	expectedCfg := &Config{Port: "8080", Stores: stores}
 
 	err = compareWithExpected(cfg, expectedCfg)
 	if err != nil {
@@ -185,3 +186,170 @@ Stores :
 		return
 	}
 }
+
+func TestUnknownBackendConfig(t *testing.T) {
+	const fileDir string = "./"
+	const filePrefix string = "testcfg"
+	fileName := fileDir + filePrefix + ".yml"
+
+	cfg := &Config{}
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+    Backup: BoltDb
+    BackupDir: ./boltdb
+`)
+	err := ioutil.WriteFile(fileName, buf, 0644)
+	defer os.Remove(fileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := cfg.Initialize(filePrefix, fileDir); err == nil {
+		t.Errorf("Expected unknown backend BoltDb to be rejected")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	const fileDir string = "./"
+	const filePrefix string = "testcfg"
+	fileName := fileDir + filePrefix + ".yml"
+	defer os.Remove(fileName)
+
+	tests := []struct {
+		config   string
+		expected []string
+	}{
+		{`
+Port : 8080
+`, []string{"Stores: required"}},
+		{`
+Port : 8080
+Stores : local
+`, []string{"Stores: expected list of stores, found string \"local\""}},
+		{`
+Port : 8080
+Stores :
+- local:
+    Backup : ShardedInMemory
+    BackupDir : ./sharded
+`, []string{"Stores[0].local.Backup: backend ShardedInMemory keeps the store only in memory"}},
+		{`
+Port : 8080
+Stores :
+- local:
+    Backup : BoltDB
+- aggregate:
+    SyncTimeout : 0
+    SyncMaxBackoff : 0
+    Aggregate :
+      - http://127.0.0.1:8081/v1/store/local
+`, []string{
+			"Stores[0].local.BackupDir: required with Backup",
+			"Stores[1].aggregate.SyncTimeout: expected integer greater than 0",
+			"Stores[1].aggregate.SyncMaxBackoff: expected integer greater than 0",
+		}},
+		{`
+Port : http
+Listen : "8080"
+Timeout : 10
+ReadTimeout : -1
+RateLimits :
+  update :
+    Rate : 0
+Auth :
+  - Name : aggregator
+    Scopes :
+      local : [read]
+Stores :
+- local:
+    Backup : BoltDb
+    BackupDir : ./boltdb
+    SyncInterval : "10"
+    WALSync : sometimes
+- aggregate:
+    SyncInterval : 0
+    SyncTimeout : -5
+    BackupDir : ./boltdb/aggregate
+    Aggregate :
+      - 127.0.0.1:8081/v1/store/local
+      - http://127.0.0.1:8082/v1/store/local
+- local:
+    BackupDirectory : ./local
+- edge:
+    Replicate :
+      - http://127.0.0.1:8081/v1/store/aggregate
+`, []string{
+			"Port: expected port number, found string \"http\"",
+			"Listen: expected host:port or unix:/path/to/socket",
+			"Timeout: unknown setting",
+			"ReadTimeout: expected integer of at least 0, found -1",
+			"RateLimits.update.Rate: expected number greater than 0",
+			"Auth[0]: credential requires Name and Token",
+			"Auth[0].Scopes.local[0]: unknown scope read",
+			"Stores[0].local.Backup: unknown backend BoltDb",
+			"Stores[0].local.SyncInterval: expected integer, found string \"10\"",
+			"Stores[0].local.WALSync: unknown sync mode sometimes",
+			"Stores[1].aggregate.SyncInterval: expected integer greater than 0",
+			"Stores[1].aggregate.SyncTimeout: expected integer of at least 0, found -5",
+			"Stores[1].aggregate.Aggregate[0]: malformed url",
+			"Stores[1].aggregate: directory ./boltdb/aggregate is also used by store local",
+			"Stores[2].local: duplicate store name, already configured at Stores[0].local",
+			"Stores[2].local.BackupDirectory: unknown setting",
+			"Stores[3].edge.ReplicateSource: required with Replicate",
+		}},
+	}
+
+	for _, test := range tests {
+		if err := ioutil.WriteFile(fileName, []byte(test.config), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+
+		cfg := &Config{}
+		err := cfg.Initialize(filePrefix, fileDir)
+		if _, ok := err.(configErrors); !ok {
+			t.Errorf("Expected configuration errors, found %v", err)
+			continue
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected %q reported, found %v", expected, err)
+			}
+		}
+		if len(err.(configErrors)) != len(test.expected) {
+			t.Errorf("Expected %d problems reported, found %v", len(test.expected), err)
+		}
+	}
+}
+
+func TestBackupOptions(t *testing.T) {
+	os.RemoveAll("./boltdboptions")
+	defer os.RemoveAll("./boltdboptions")
+
+	store := Store{Name: "local", Backup: "BoltDB", Backupdir: "./boltdboptions", BackupOptions: map[string]interface{}{"TimeoutSec": 1}}
+	backup, err := createStore(store)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	backup.Shutdown()
+
+	store.BackupOptions = map[string]interface{}{"Timeout": 1}
+	if _, err := createStore(store); err == nil {
+		t.Errorf("Expected unknown backend option to be rejected")
+	}
+}
+
+func TestTieredPrimaryConfig(t *testing.T) {
+	if _, err := createPrimaryStore(Store{Name: "local", PrimaryCacheMB: 1}); err == nil {
+		t.Errorf("Expected tiered primary store without backup to be rejected")
+	}
+
+	store := Store{Name: "local", Backup: "InMemory", PrimaryCacheMB: 1, Shards: 4}
+	if _, err := createPrimaryStore(store); err == nil {
+		t.Errorf("Expected tiered primary store with shards to be rejected")
+	}
+}
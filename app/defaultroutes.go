@@ -1,32 +1,64 @@
 package app
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 var defaultRoutes = []Route{
-	Route{"GET", "/health", HealthCheckHandler},
-	Route{"GET", "/debug/pprof/", IndexHandler},
-	Route{"GET", "/debug/pprof/heap", HeapHandler},
-	Route{"GET", "/debug/pprof/goroutine", GoroutineHandler},
-	Route{"GET", "/debug/pprof/block", BlockHandler},
-	Route{"GET", "/debug/pprof/threadcreate", ThreadCreateHandler},
-	Route{"GET", "/debug/pprof/cmdline", CmdlineHandler},
-	Route{"GET", "/debug/pprof/profile", ProfileHandler},
-	Route{"GET", "/debug/pprof/symbol", SymbolHandler},
-	Route{"POST", "/debug/pprof/symbol", SymbolHandler},
-	Route{"GET", "/debug/pprof/trace", TraceHandler},
-	Route{"GET", "/debug/pprof/mutex", MutexHandler},
+	Route{"GET", "/debug/pprof/", IndexHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/heap", HeapHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/goroutine", GoroutineHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/block", BlockHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/threadcreate", ThreadCreateHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/cmdline", CmdlineHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/profile", ProfileHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/symbol", SymbolHandler, scopeAdmin},
+	Route{"POST", "/debug/pprof/symbol", SymbolHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/trace", TraceHandler, scopeAdmin},
+	Route{"GET", "/debug/pprof/mutex", MutexHandler, scopeAdmin},
 }
 
-// HealthCheckHandler provides health check for external monitoring applications
+// HealthCheckHandler provides liveness check for external monitoring applications, kept for routers
+// registering it without a Context, Context.HealthCheckHandler reports aggregate sync health as well
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	respondOK(w, "ok")
 }
 
+// HealthCheckHandler provides health check for external monitoring applications
+// reports degraded when any aggregate url has been failing longer than its threshold
+func (ctx *Context) HealthCheckHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	degraded := make([]string, 0)
+	now := time.Now()
+	ctx.storesLock.RLock()
+	defer ctx.storesLock.RUnlock()
+	for storeName, store := range ctx.stores {
+		// syncer is replaced under reloadLock when configuration is reloaded
+		syncer := store.aggregateSyncer()
+		if syncer == nil {
+			continue
+		}
+		for _, status := range syncer.status(now) {
+			if status.Degraded {
+				degraded = append(degraded, fmt.Sprintf("store %s url %s failing since %s: %s", storeName, status.URL, status.FailingSince.Format(time.RFC3339), status.LastError))
+			}
+		}
+	}
+
+	if len(degraded) == 0 {
+		respondOK(w, "ok")
+		return
+	}
+
+	response, _ := json.Marshal(map[string]interface{}{"status": "degraded", "message": "aggregate sync failing", "degraded": degraded})
+	respondJSON(w, http.StatusOK, response)
+}
+
 // IndexHandler will pass the call from /debug/pprof to pprof
 func IndexHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	pprof.Index(w, r)
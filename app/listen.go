@@ -0,0 +1,113 @@
+package app
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// unixPrefix of listen addresses of unix sockets
+const unixPrefix string = "unix:"
+
+// storeBodyRoutes carry complete stores as body, limited by MaxRestoreBodyMB rather than MaxBodyMB
+var storeBodyRoutes = map[string]bool{
+	"/store/:store/restore":   true,
+	"/store/:store/replicate": true,
+}
+
+// listen on tcp host:port, including [ipv6]:port, or unix:/path/to/socket
+// stale socket file left by an unclean shutdown is removed
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	socket := strings.TrimPrefix(address, unixPrefix)
+	if len(socket) == 0 {
+		return nil, fmt.Errorf("invalid listen address %s, expected unix:/path/to/socket", address)
+	}
+	if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is already in use", socket)
+		}
+		os.Remove(socket)
+	}
+	// socket file is removed when listener is closed
+	return net.Listen("unix", socket)
+}
+
+// loopback reports whether address only accepts local clients, on a loopback address or unix socket
+func loopback(address string) bool {
+	if strings.HasPrefix(address, unixPrefix) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newServer serving handler with configured timeouts
+func (ctx *Context) newServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  time.Duration(ctx.config.ReadTimeoutSec) * time.Second,
+		WriteTimeout: time.Duration(ctx.config.WriteTimeoutSec) * time.Second,
+		IdleTimeout:  time.Duration(ctx.config.IdleTimeoutSec) * time.Second,
+		TLSConfig:    tlsConfig}
+}
+
+// serve srv on listener until it is shutdown, serving https when srv has TLSConfig
+// failure of the listener is sent to serveErrors rather than exiting, so stores are still shut down
+func (ctx *Context) serve(srv *http.Server, listener net.Listener) {
+	defer ctx.serving.Done()
+	var err error
+	if srv.TLSConfig != nil {
+		// certificate is already loaded into TLSConfig
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("error serving", "address", listener.Addr().String(), "error", err)
+		ctx.serveErrors <- fmt.Errorf("error serving %s: %v", listener.Addr().String(), err)
+	}
+}
+
+// bodyLimit in bytes of requests of route, replaced when configuration is reloaded
+func (ctx *Context) bodyLimit(routeURI string) int64 {
+	ctx.storesLock.RLock()
+	defer ctx.storesLock.RUnlock()
+	if storeBodyRoutes[routeURI] {
+		return int64(ctx.config.MaxRestoreBodyMB) << 20
+	}
+	return int64(ctx.config.MaxBodyMB) << 20
+}
+
+// BodyLimitMiddleware Handler limiting size of request body, 0 is unlimited
+func (ctx *Context) BodyLimitMiddleware(routeURI string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if limit := ctx.bodyLimit(routeURI); limit > 0 {
+			if r.ContentLength > limit {
+				respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds limit of %d bytes", limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r, ps)
+	}
+}
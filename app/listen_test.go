@@ -0,0 +1,192 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnixAndAdmin(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Listen : unix:./listentest.sock
+AdminListen : 127.0.0.1:8081
+MaxBodyMB : 1
+MaxRestoreBodyMB : 2
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(1 * time.Second)
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(dialCtx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(dialCtx, "unix", "./listentest.sock")
+		},
+	}}
+	largeUpdate := []byte(`{"m1": {"num": "` + strings.Repeat("6", 1<<20) + `"}}`)
+	for _, test := range []struct {
+		client   *http.Client
+		method   string
+		url      string
+		body     io.Reader
+		expected int
+	}{
+		{unixClient, "POST", "http://unix/v1/store/local/update", strings.NewReader(`{"m1": {"num": "6.13"}}`), http.StatusOK},
+		{unixClient, "POST", "http://unix/v1/store/local/update", bytes.NewReader(largeUpdate), http.StatusRequestEntityTooLarge},
+		// body of unknown length is limited while it is read
+		{unixClient, "POST", "http://unix/v1/store/local/update", ioutil.NopCloser(bytes.NewReader(largeUpdate)), http.StatusRequestEntityTooLarge},
+		{unixClient, "POST", "http://unix/v1/store/local/restore", bytes.NewReader(largeUpdate), http.StatusBadRequest},
+		{unixClient, "GET", "http://unix/v1/health", nil, http.StatusNotFound},
+		{http.DefaultClient, "GET", "http://127.0.0.1:8081/v1/health", nil, http.StatusOK},
+		{http.DefaultClient, "GET", "http://127.0.0.1:8081/v1/debug/pprof/cmdline", nil, http.StatusOK},
+		{http.DefaultClient, "GET", "http://127.0.0.1:8081/v1/store/local/stats", nil, http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(test.method, test.url, test.body)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		resp, err := test.client.Do(req)
+		if err != nil {
+			t.Errorf("Expected %s %s to return %d, found %v", test.method, test.url, test.expected, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("Expected %s %s to return %d, found %d", test.method, test.url, test.expected, resp.StatusCode)
+		}
+	}
+
+	DeleteContext(ctx)
+	if _, err := os.Stat("./listentest.sock"); !os.IsNotExist(err) {
+		t.Errorf("Expected unix socket removed on shutdown, found %v", err)
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	if listener, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("ipv6 loopback not available")
+	} else {
+		listener.Close()
+	}
+
+	buf := []byte(`
+Port : 8080
+Listen : "[::1]:8080"
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	resp, err := http.Get("http://[::1]:8080/v1/health")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected health over ipv6, found %v, %v", resp, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func TestServeError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// closed listener fails serving
+	listener.Close()
+
+	ctx := &Context{serveErrors: make(chan error, 2)}
+	ctx.serving.Add(1)
+	ctx.serve(&http.Server{}, listener)
+	select {
+	case err := <-ctx.serveErrors:
+		if !strings.Contains(err.Error(), "error serving") {
+			t.Errorf("Expected error serving, found %v", err)
+		}
+	default:
+		t.Error("Expected failing listener reported to caller")
+	}
+}
+
+func TestDeleteContextClosesListener(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := DeleteContext(ctx); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// listener is closed by the time context is deleted
+	listener, err := net.Listen("tcp", "127.0.0.1:8080")
+	if err != nil {
+		t.Errorf("Expected address released on delete, found %v", err)
+		return
+	}
+	listener.Close()
+}
+
+func TestLoopback(t *testing.T) {
+	for address, expected := range map[string]bool{
+		"127.0.0.1:8080":       true,
+		"[::1]:8080":           true,
+		"localhost:8080":       true,
+		"unix:./listen.sock":   true,
+		":8080":                false,
+		"0.0.0.0:8080":         false,
+		"10.0.0.1:8080":        false,
+		"store.example.com:80": false,
+	} {
+		if loopback(address) != expected {
+			t.Errorf("Expected loopback of %s to be %v", address, expected)
+		}
+	}
+}
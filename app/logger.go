@@ -1,17 +1,178 @@
 package app
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-// LoggerMiddleware Handler
+// requestIDHeader carries id of request, taken from the client when valid or generated
+const requestIDHeader string = "X-Request-ID"
+
+// parseLogLevel debug, info, warn or error
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid LogLevel %s, expected debug, info, warn or error", level)
+	}
+	return l, nil
+}
+
+// openLogOutput stderr, stdout or file path appended to
+func openLogOutput(output string) (io.Writer, io.Closer, error) {
+	switch strings.ToLower(output) {
+	case "", "stderr":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return os.Stdout, nil, nil
+	}
+	file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file, nil
+}
+
+// initializeLogger sets json logger of configured level and output as default
+// log package output of core stores is written through it as well
+func (ctx *Context) initializeLogger() error {
+	level, err := parseLogLevel(ctx.config.LogLevel)
+	if err != nil {
+		return err
+	}
+	output, closer, err := openLogOutput(ctx.config.LogOutput)
+	if err != nil {
+		return err
+	}
+	ctx.logOutput = closer
+	// level is changed when configuration is reloaded
+	ctx.logLevel = new(slog.LevelVar)
+	ctx.logLevel.Set(level)
+
+	logger := slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{Level: ctx.logLevel}))
+	slog.SetDefault(logger)
+	return nil
+}
+
+// closeLogger restores logging to stderr, closing log file
+func (ctx *Context) closeLogger() {
+	if ctx.logOutput == nil {
+		return
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	ctx.logOutput.Close()
+	ctx.logOutput = nil
+}
+
+// validRequestID client supplied ids are echoed only if short and printable
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// responseRecorder captures status, size and error message written by handler, flushing for watch streams
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	err    string
+	// name of credential authenticating the request
+	client string
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap underlying ResponseWriter, so http.ResponseController reaches the connection, e.g. to clear write deadline of watch streams
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// recordResponse wraps w unless it already records the response
+func recordResponse(w http.ResponseWriter) *responseRecorder {
+	if recorder, ok := w.(*responseRecorder); ok {
+		return recorder
+	}
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// LoggerMiddleware Handler assigning request id and logging every request once it completes
+// level is warn for client errors and error for server errors
 func LoggerMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		// log app name, method and URI
-		log.Printf("[keypropstore] Method: %s, URI: %s\n", r.Method, r.RequestURI)
-		next(w, r, ps)
+		start := time.Now()
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		recorder := recordResponse(w)
+		next(recorder, r, ps)
+
+		level := slog.LevelInfo
+		switch {
+		case recorder.status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case recorder.status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", requestID),
+			slog.String("method", r.Method),
+			slog.String("uri", r.RequestURI),
+			slog.String("remote", r.RemoteAddr),
+			slog.Int("status", recorder.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes_in", r.ContentLength),
+			slog.Int64("bytes_out", recorder.bytes),
+		}
+		if storeName := ps.ByName("store"); len(storeName) > 0 {
+			attrs = append(attrs, slog.String("store", storeName))
+		}
+		if len(recorder.client) > 0 {
+			attrs = append(attrs, slog.String("client", recorder.client))
+		}
+		if len(recorder.err) > 0 {
+			attrs = append(attrs, slog.String("error", recorder.err))
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
 	}
 }
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestLogging(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+LogLevel : debug
+LogOutput : ./requestlog.json
+Stores :
+- local:
+`)
+
+	os.Remove("./requestlog.json")
+	defer os.Remove("./requestlog.json")
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(1 * time.Second)
+
+	// client supplied request id is echoed
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:8080/v1/store/local/update", bytes.NewBufferString(`{"m1": {"num": "6.13"}}`))
+	req.Header.Set(requestIDHeader, "client-id-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	resp.Body.Close()
+	if requestID := resp.Header.Get(requestIDHeader); requestID != "client-id-1" {
+		t.Errorf("Expected client request id echoed, found %s", requestID)
+	}
+
+	// error responses include generated request id
+	resp, err = http.Post("http://127.0.0.1:8080/v1/store/missing/query", "application/json", bytes.NewBufferString(`{"num": "6.13"}`))
+	if err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	var errResponse map[string]string
+	json.NewDecoder(resp.Body).Decode(&errResponse)
+	resp.Body.Close()
+	requestID := resp.Header.Get(requestIDHeader)
+	if len(requestID) == 0 || errResponse["requestId"] != requestID {
+		t.Errorf("Expected error response to include request id %s, found %v", requestID, errResponse)
+	}
+
+	DeleteContext(ctx)
+
+	logFile, err := os.Open("./requestlog.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer logFile.Close()
+
+	requests := make(map[string]map[string]interface{})
+	scanner := bufio.NewScanner(logFile)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Errorf("Expected json log line, found %s", scanner.Text())
+			continue
+		}
+		if line["msg"] == "request" {
+			requests[line["request_id"].(string)] = line
+		}
+	}
+
+	if line, ok := requests["client-id-1"]; !ok || line["level"] != "INFO" || line["status"] != float64(http.StatusOK) || line["store"] != "local" {
+		t.Errorf("Expected update request logged, found %v", line)
+	}
+	line := requests[requestID]
+	if errMessage, _ := line["error"].(string); line["level"] != "WARN" || line["status"] != float64(http.StatusBadRequest) || !strings.Contains(errMessage, "missing") {
+		t.Errorf("Expected failed query logged with its error, found %v", line)
+	}
+}
+
+func TestInvalidLogLevel(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+LogLevel : verbose
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if ctx, err := CreateContext("config", "./config"); err == nil {
+		DeleteContext(ctx)
+		t.Errorf("Expected invalid log level to fail")
+	}
+}
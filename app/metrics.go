@@ -0,0 +1,237 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// appMetrics exposed in prometheus text format at /v1/metrics
+type appMetrics struct {
+	registry        *prometheus.Registry
+	stores          *storeCollector
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	storeOpDuration *prometheus.HistogramVec
+	syncs           *prometheus.CounterVec
+	syncDuration    *prometheus.HistogramVec
+}
+
+// metrics of the process, shared by all contexts
+var metrics = newAppMetrics()
+
+func newAppMetrics() *appMetrics {
+	m := &appMetrics{
+		registry: prometheus.NewRegistry(),
+		stores:   newStoreCollector(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keypropstore_http_requests_total",
+			Help: "HTTP requests by route, method, store and status code.",
+		}, []string{"route", "method", "store", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "keypropstore_http_request_duration_seconds",
+			Help:    "HTTP request latency by route, method and store.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "store"}),
+		storeOpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "keypropstore_store_operation_duration_seconds",
+			Help:    "Latency of core store operations by backend and operation.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 12),
+		}, []string{"backend", "op"}),
+		syncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keypropstore_aggregate_sync_total",
+			Help: "Aggregate url syncs by store, url and result.",
+		}, []string{"store", "url", "result"}),
+		syncDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "keypropstore_aggregate_sync_duration_seconds",
+			Help:    "Aggregate url sync duration by store and url.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"store", "url"}),
+	}
+	m.registry.MustRegister(m.stores, m.requests, m.requestDuration, m.storeOpDuration, m.syncs, m.syncDuration,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+// observeStoreOp records latency of core operation op on store since start
+func (m *appMetrics) observeStoreOp(store core.Store, op string, start time.Time) {
+	m.storeOpDuration.WithLabelValues(core.BackendName(store), op).Observe(time.Since(start).Seconds())
+}
+
+// observeSync records result and duration of syncing aggregate url of store
+func (m *appMetrics) observeSync(storeName, aggregateURL string, err error, duration time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.syncs.WithLabelValues(storeName, aggregateURL, result).Inc()
+	m.syncDuration.WithLabelValues(storeName, aggregateURL).Observe(duration.Seconds())
+}
+
+// MetricsMiddleware Handler counting requests and their latency by route and store
+// store label is empty for unknown stores, so requests can't grow the number of series
+func (ctx *Context) MetricsMiddleware(routeURI string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		recorder := recordResponse(w)
+		next(recorder, r, ps)
+
+		storeName := ps.ByName("store")
+		if _, ok := ctx.store(storeName); !ok {
+			storeName = ""
+		}
+		metrics.requests.WithLabelValues(routeURI, r.Method, storeName, strconv.Itoa(recorder.status)).Inc()
+		metrics.requestDuration.WithLabelValues(routeURI, r.Method, storeName).Observe(time.Since(start).Seconds())
+	}
+}
+
+// storeStatsInterval between computing sizes of in memory stores, which iterates every posting list
+const storeStatsInterval time.Duration = 30 * time.Second
+
+// cachedStats size of a store computed at time
+type cachedStats struct {
+	stats core.StoreStats
+	at    time.Time
+}
+
+// storeCollector reports size of stores of every running context when scraped
+type storeCollector struct {
+	contextsLock sync.Mutex
+	contexts     map[*Context]struct{}
+	statsLock    sync.Mutex
+	statsCache   map[*CoreStores]cachedStats
+	properties   *prometheus.Desc
+	keys         *prometheus.Desc
+	associations *prometheus.Desc
+	diskBytes    *prometheus.Desc
+	queueDepth   *prometheus.Desc
+}
+
+func newStoreCollector() *storeCollector {
+	return &storeCollector{
+		contexts:     make(map[*Context]struct{}),
+		statsCache:   make(map[*CoreStores]cachedStats),
+		properties:   prometheus.NewDesc("keypropstore_store_properties", "Distinct properties of in memory primary store.", []string{"store"}, nil),
+		keys:         prometheus.NewDesc("keypropstore_store_keys", "Distinct keys of in memory primary store.", []string{"store"}, nil),
+		associations: prometheus.NewDesc("keypropstore_store_associations", "Associations of in memory primary store.", []string{"store"}, nil),
+		diskBytes:    prometheus.NewDesc("keypropstore_store_disk_bytes", "Bytes used on disk by backup or tiered primary store.", []string{"store"}, nil),
+		queueDepth:   prometheus.NewDesc("keypropstore_store_backup_queue_depth", "Changes queued for write behind backup store.", []string{"store"}, nil),
+	}
+}
+
+func (c *storeCollector) add(ctx *Context) {
+	c.contextsLock.Lock()
+	defer c.contextsLock.Unlock()
+	c.contexts[ctx] = struct{}{}
+}
+
+func (c *storeCollector) remove(ctx *Context) {
+	c.contextsLock.Lock()
+	defer c.contextsLock.Unlock()
+	delete(c.contexts, ctx)
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.properties
+	ch <- c.keys
+	ch <- c.associations
+	ch <- c.diskBytes
+	ch <- c.queueDepth
+}
+
+// storeStats of in memory primary store, computed at most once every storeStatsInterval
+// so frequent scrapes don't repeatedly iterate large stores
+func (c *storeCollector) storeStats(store *CoreStores, primary core.StatsStore, now time.Time) (core.StoreStats, error) {
+	c.statsLock.Lock()
+	cached, ok := c.statsCache[store]
+	c.statsLock.Unlock()
+	if ok && now.Sub(cached.at) < storeStatsInterval {
+		return cached.stats, nil
+	}
+
+	stats, err := primary.Stats(0)
+	if err != nil {
+		return stats, err
+	}
+	c.statsLock.Lock()
+	c.statsCache[store] = cachedStats{stats: stats, at: now}
+	c.statsLock.Unlock()
+	return stats, nil
+}
+
+// dropStats of stores no longer running
+func (c *storeCollector) dropStats(running map[string]*CoreStores) {
+	stores := make(map[*CoreStores]bool, len(running))
+	for _, store := range running {
+		stores[store] = true
+	}
+
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	for store := range c.statsCache {
+		if !stores[store] {
+			delete(c.statsCache, store)
+		}
+	}
+}
+
+// Collect sizes, disk backed primary stores are not counted since it would read the complete db
+// store names are expected to be unique across contexts, only the first store of a name is reported
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	stores := make(map[string]*CoreStores)
+	c.contextsLock.Lock()
+	for ctx := range c.contexts {
+		ctx.storesLock.RLock()
+		for name, store := range ctx.stores {
+			if _, ok := stores[name]; !ok {
+				stores[name] = store
+			}
+		}
+		ctx.storesLock.RUnlock()
+	}
+	c.contextsLock.Unlock()
+	c.dropStats(stores)
+
+	now := time.Now()
+	for name, store := range stores {
+		switch primary := store.primary.(type) {
+		case *core.InMemoryStore, *core.ShardedInMemoryStore:
+			stats, err := c.storeStats(store, primary.(core.StatsStore), now)
+			if err != nil {
+				slog.Error("error collecting stats of store", "store", name, "error", err)
+				break
+			}
+			ch <- prometheus.MustNewConstMetric(c.properties, prometheus.GaugeValue, float64(stats.Properties), name)
+			ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(stats.Keys), name)
+			ch <- prometheus.MustNewConstMetric(c.associations, prometheus.GaugeValue, float64(stats.Associations), name)
+		}
+
+		disk, ok := store.backup.(core.DiskStore)
+		if !ok {
+			disk, ok = store.primary.(core.DiskStore)
+		}
+		if ok {
+			if size, err := disk.DiskSize(); err == nil {
+				ch <- prometheus.MustNewConstMetric(c.diskBytes, prometheus.GaugeValue, float64(size), name)
+			}
+		}
+
+		if store.writeBehind != nil {
+			depth := store.writeBehind.status(now).Depth
+			ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(depth), name)
+		}
+	}
+}
+
+// metricsHandler serves metrics in prometheus text format
+func (ctx *Context) metricsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
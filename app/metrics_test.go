@@ -0,0 +1,115 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+)
+
+func TestMetrics(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+- aggregate:
+    SyncInterval : 1
+    Aggregate:
+      - http://127.0.0.1:1/v1/store/missing
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	const storeURL string = "http://127.0.0.1:8080/v1/store/local"
+	if err := postStore(storeURL+"/update", []byte(`{"m1": {"num": "6.13", "strs": "a"}, "m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := queryStoreKeys(storeURL+"/query", []byte(`{"num": "6.13"}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// wait for failing aggregate url to be synced
+	time.Sleep(1500 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:8080/v1/metrics")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, expected := range []string{
+		`keypropstore_http_requests_total{code="200",method="POST",route="/store/:store/update",store="local"}`,
+		`keypropstore_http_request_duration_seconds_count{method="POST",route="/store/:store/query",store="local"}`,
+		`keypropstore_store_operation_duration_seconds_count{backend="InMemory",op="apply"}`,
+		`keypropstore_store_operation_duration_seconds_count{backend="InMemory",op="query"}`,
+		`keypropstore_store_keys{store="local"} 2`,
+		`keypropstore_store_associations{store="local"} 3`,
+		`keypropstore_aggregate_sync_total{result="failure",store="aggregate",url="http://127.0.0.1:1/v1/store/missing"}`,
+		`keypropstore_aggregate_sync_duration_seconds_count{store="aggregate",url="http://127.0.0.1:1/v1/store/missing"}`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected metrics to contain %s", expected)
+		}
+	}
+}
+
+// countingStats counts computing stats of the wrapped store
+type countingStats struct {
+	core.StatsStore
+	calls int
+}
+
+func (s *countingStats) Stats(largest int) (core.StoreStats, error) {
+	s.calls++
+	return s.StatsStore.Stats(largest)
+}
+
+func TestStoreStatsCached(t *testing.T) {
+	primary := &core.ShardedInMemoryStore{}
+	core.InitializeStore(primary, nil)
+	store := &CoreStores{primary: primary}
+	counting := &countingStats{StatsStore: primary}
+	collector := newStoreCollector()
+
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(time.Second), now.Add(storeStatsInterval)} {
+		if _, err := collector.storeStats(store, counting, at); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if counting.calls != 2 {
+		t.Errorf("Expected stats computed once per interval, computed %d times", counting.calls)
+	}
+
+	collector.dropStats(map[string]*CoreStores{})
+	if len(collector.statsCache) != 0 {
+		t.Errorf("Expected stats of stopped stores dropped, found %d", len(collector.statsCache))
+	}
+}
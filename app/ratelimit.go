@@ -0,0 +1,202 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RateLimit requests per second allowed per client, upto Burst requests at once
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// backupRoutes serialize or replace complete stores, limited by MaxConcurrentBackups
+var backupRoutes = map[string]bool{
+	"/store/:store/backup":                      true,
+	"/store/:store/restore":                     true,
+	"/store/:store/snapshots/:snapshot/restore": true,
+}
+
+// rateLimitSweepInterval between removing buckets of idle clients
+const rateLimitSweepInterval time.Duration = time.Minute
+
+// tokenBucket of a single client, refilled at rate upto burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter token buckets per client of a route class
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &rateLimiter{rate: limit.Rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token of client, otherwise returns time until a token is available
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep buckets refilled to burst, they are the same as new buckets
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimiters of configured route classes, along with slots of concurrent backups
+type rateLimiters struct {
+	classes     map[string]*rateLimiter
+	backupSlots chan struct{}
+	backupLock  sync.Mutex
+	backupTime  time.Duration
+}
+
+func newRateLimiters(cfg *Config) *rateLimiters {
+	limiters := &rateLimiters{classes: make(map[string]*rateLimiter)}
+	for class, limit := range cfg.RateLimits {
+		limiters.classes[class] = newRateLimiter(limit)
+	}
+	if cfg.MaxConcurrentBackups > 0 {
+		limiters.backupSlots = make(chan struct{}, cfg.MaxConcurrentBackups)
+	}
+	return limiters
+}
+
+// backupServed records duration of a backup or restore, averaged over recent requests
+func (l *rateLimiters) backupServed(elapsed time.Duration) {
+	l.backupLock.Lock()
+	defer l.backupLock.Unlock()
+	if l.backupTime == 0 {
+		l.backupTime = elapsed
+	} else {
+		l.backupTime = (3*l.backupTime + elapsed) / 4
+	}
+}
+
+// backupWait until a backup slot is likely released, the average duration of backups
+// and at least a second, which is also used until a backup completes
+func (l *rateLimiters) backupWait() time.Duration {
+	l.backupLock.Lock()
+	defer l.backupLock.Unlock()
+	if l.backupTime < time.Second {
+		return time.Second
+	}
+	return l.backupTime
+}
+
+// remoteClient host of the client
+func remoteClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// unix socket clients have no address
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitClient name of credential presented by the request, otherwise remote host of the client
+// clients behind a shared address are limited separately, while invalid tokens are limited by address
+func (ctx *Context) rateLimitClient(r *http.Request) string {
+	if credential, ok := authenticate(ctx.credentials(), requestToken(r)); ok {
+		return "credential " + credential.Name
+	}
+	return remoteClient(r)
+}
+
+// respondTooManyRequests asking client to retry after wait, rounded up to seconds
+func respondTooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, message)
+}
+
+// rateLimiters configured, replaced when configuration is reloaded
+func (ctx *Context) rateLimiters() *rateLimiters {
+	ctx.storesLock.RLock()
+	defer ctx.storesLock.RUnlock()
+	return ctx.limiters
+}
+
+// RateLimitMiddleware Handler limiting requests of each credential or remote client by route class, the scope of the route
+// placed before authentication, so requests with invalid credentials are limited as well
+func (ctx *Context) RateLimitMiddleware(route Route, next httprouter.Handle) httprouter.Handle {
+	if route.Scope == scopeNone {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if limiter, ok := ctx.rateLimiters().classes[route.Scope]; ok {
+			client := ctx.rateLimitClient(r)
+			if allowed, wait := limiter.allow(client, time.Now()); !allowed {
+				respondTooManyRequests(w, wait, fmt.Sprintf("rate limit of %s requests exceeded by %s", route.Scope, client))
+				return
+			}
+		}
+		next(w, r, ps)
+	}
+}
+
+// BackupLimitMiddleware Handler limiting concurrent backup and restore requests of all clients
+// placed after authentication, so only authorized requests take a slot
+func (ctx *Context) BackupLimitMiddleware(route Route, next httprouter.Handle) httprouter.Handle {
+	if !backupRoutes[route.RouteURI] {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		limiters := ctx.rateLimiters()
+		if limiters.backupSlots == nil {
+			next(w, r, ps)
+			return
+		}
+
+		select {
+		case limiters.backupSlots <- struct{}{}:
+			defer func() { <-limiters.backupSlots }()
+		default:
+			respondTooManyRequests(w, limiters.backupWait(), "too many concurrent backup and restore requests")
+			return
+		}
+		defer func(start time.Time) { limiters.backupServed(time.Since(start)) }(time.Now())
+		next(w, r, ps)
+	}
+}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow("client", now); !allowed {
+			t.Errorf("Expected burst of 3 requests allowed, request %d limited", i)
+		}
+	}
+	if allowed, wait := limiter.allow("client", now); allowed || wait != 500*time.Millisecond {
+		t.Errorf("Expected request over burst limited for 500ms, found %v, %v", allowed, wait)
+	}
+	if allowed, _ := limiter.allow("other", now); !allowed {
+		t.Errorf("Expected other client allowed")
+	}
+	if allowed, _ := limiter.allow("client", now.Add(500*time.Millisecond)); !allowed {
+		t.Errorf("Expected request allowed once bucket is refilled")
+	}
+
+	// idle clients are removed once their buckets are full
+	limiter.allow("client", now.Add(2*rateLimitSweepInterval))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected idle client removed, found %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+RateLimits :
+  update :
+    Rate : 0.5
+    Burst : 2
+MaxConcurrentBackups : 1
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	const storeURL string = "http://127.0.0.1:8080/v1/store/local"
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := http.Post(storeURL+"/update", "application/json", bytes.NewBufferString(`{"m1": {"num": "6.13"}}`))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected update %d to return %d, found %d", i, expected, resp.StatusCode)
+		}
+		if expected == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "2" {
+			t.Errorf("Expected limited update to be retried after 2 seconds, found %s", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// other route classes are not limited
+	if _, err := queryStoreKeys(storeURL+"/query", []byte(`{"num": "6.13"}`)); err != nil {
+		t.Error(err)
+	}
+
+	// backup is refused while another backup holds the only slot
+	handler := ctx.BackupLimitMiddleware(Route{"GET", "/store/:store/backup", ctx.backupStore, scopeBackup}, ctx.backupStore)
+	ctx.limiters.backupSlots <- struct{}{}
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", storeURL+"/backup", nil), httprouter.Params{{Key: "store", Value: "local"}})
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected concurrent backup refused, found %d", recorder.Code)
+	}
+	<-ctx.limiters.backupSlots
+
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", storeURL+"/backup", nil), httprouter.Params{{Key: "store", Value: "local"}})
+	if recorder.Code != http.StatusOK || len(ctx.limiters.backupSlots) != 0 {
+		t.Errorf("Expected backup served and its slot released, found %d", recorder.Code)
+	}
+
+	// clients are asked to retry after the average duration of backups
+	ctx.limiters.backupServed(5 * time.Second)
+	ctx.limiters.backupSlots <- struct{}{}
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", storeURL+"/backup", nil), httprouter.Params{{Key: "store", Value: "local"}})
+	if retry := recorder.Header().Get("Retry-After"); recorder.Code != http.StatusTooManyRequests || retry == "1" {
+		t.Errorf("Expected concurrent backup refused for the average backup duration, found %d, %s", recorder.Code, retry)
+	}
+	<-ctx.limiters.backupSlots
+}
+
+func TestRateLimitInvalidCredentials(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+RateLimits :
+  query :
+    Rate : 0.5
+    Burst : 1
+Auth :
+  - Name : reader
+    Token : reader-token
+    Scopes :
+      local : [query]
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	// guessing tokens is limited by remote address before credentials are checked
+	for i, expected := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:8080/v1/store/local/query", bytes.NewBufferString(`{"num": "6.13"}`))
+		req.Header.Set("X-API-Key", "guessed-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected query %d with invalid token to return %d, found %d", i, expected, resp.StatusCode)
+		}
+	}
+
+	// valid credentials are limited by credential rather than the shared address
+	for i, limited := range []bool{false, true} {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:8080/v1/store/local/query", bytes.NewBufferString(`{"num": "6.13"}`))
+		req.Header.Set("X-API-Key", "reader-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if (resp.StatusCode == http.StatusTooManyRequests) != limited {
+			t.Errorf("Expected query %d with valid token limited %v, found %d", i, limited, resp.StatusCode)
+		}
+	}
+}
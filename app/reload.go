@@ -0,0 +1,311 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// configWatchInterval between checks of configuration file for modifications
+const configWatchInterval time.Duration = time.Second
+
+// liveSettings applied without restart, other settings of the listener, TLS and log output require a restart
+var liveSettings = map[string]bool{
+	"LogLevel":             true,
+	"Auth":                 true,
+	"MaxBodyMB":            true,
+	"MaxRestoreBodyMB":     true,
+	"RateLimits":           true,
+	"MaxConcurrentBackups": true,
+}
+
+// liveStoreSettings applied to a running store by restarting its aggregate sync and replication
+// other settings change how the store is opened, such as its backend, and require a restart
+var liveStoreSettings = map[string]bool{
+	"AggregateURLs":           true,
+	"SyncIntervalSec":         true,
+	"SyncTimeoutSec":          true,
+	"SyncParallel":            true,
+	"SyncMaxBackoffSec":       true,
+	"SyncFailureThresholdSec": true,
+	"SyncToken":               true,
+	"ReplicateURLs":           true,
+	"ReplicateSource":         true,
+	"ReplicateBatchSize":      true,
+	"ReplicateQueueSize":      true,
+	"ReplicateToken":          true,
+}
+
+// reloadResult changes of configuration applied and those refused, which require a restart
+type reloadResult struct {
+	Applied []string `json:"applied"`
+	Refused []string `json:"refused"`
+}
+
+// changedFields names of fields differing between a and b of the same struct type
+func changedFields(a, b interface{}) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	changed := make([]string, 0)
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// splitSettings into those applied live and those requiring a restart
+func splitSettings(changed []string, live map[string]bool) ([]string, []string) {
+	var applied, refused []string
+	for _, setting := range changed {
+		if live[setting] {
+			applied = append(applied, setting)
+		} else {
+			refused = append(refused, setting)
+		}
+	}
+	return applied, refused
+}
+
+// watchConfig reloads configuration whenever configuration file is modified, until done is closed
+func (ctx *Context) watchConfig(file string, done chan struct{}) {
+	defer ctx.watching.Done()
+
+	info, _ := os.Stat(file)
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			current, err := os.Stat(file)
+			if err != nil || info != nil && current.ModTime().Equal(info.ModTime()) && current.Size() == info.Size() {
+				continue
+			}
+			info = current
+			slog.Info("configuration file modified, reloading", "file", file)
+			ctx.reloadConfig()
+		}
+	}
+}
+
+// reloadConfig applies changes of configuration file to running stores and settings
+// an invalid configuration is refused as a whole, otherwise changes requiring a restart are refused
+// and logged while the remaining changes are applied
+// stores are opened, reconfigured and shut down outside of storesLock, so requests are served meanwhile
+func (ctx *Context) reloadConfig() (reloadResult, error) {
+	ctx.reloadLock.Lock()
+	defer ctx.reloadLock.Unlock()
+	result := reloadResult{Applied: make([]string, 0), Refused: make([]string, 0)}
+
+	// file found when context was created, rather than the last configuration read by any context
+	v, err := readConfigFile(ctx.configFile)
+	if err != nil {
+		slog.Error("error reloading configuration", "error", err)
+		return result, err
+	}
+	var cfg Config
+	if err := cfg.load(v); err != nil {
+		slog.Error("invalid configuration refused", "error", err)
+		return result, err
+	}
+
+	reload, err := ctx.prepareReload(&cfg, &result)
+	if err == nil {
+		err = ctx.reloadStores(reload, &result)
+	}
+
+	for _, change := range result.Applied {
+		slog.Info("configuration change applied", "change", change)
+	}
+	for _, change := range result.Refused {
+		slog.Error("configuration change refused", "change", change)
+	}
+	if err != nil {
+		slog.Error("error reloading configuration", "error", err)
+		return result, err
+	}
+	return result, nil
+}
+
+// configSettings of cfg other than stores, which are compared separately
+func configSettings(cfg Config) Config {
+	cfg.Stores = nil
+	return cfg
+}
+
+// applySetting of cfg changed in configuration file
+func (ctx *Context) applySetting(setting string, cfg *Config) error {
+	switch setting {
+	case "LogLevel":
+		level, err := parseLogLevel(cfg.LogLevel)
+		if err != nil {
+			return err
+		}
+		ctx.config.LogLevel = cfg.LogLevel
+		if ctx.logLevel != nil {
+			ctx.logLevel.Set(level)
+		}
+	case "Auth":
+		ctx.config.Auth = cfg.Auth
+	case "MaxBodyMB":
+		ctx.config.MaxBodyMB = cfg.MaxBodyMB
+	case "MaxRestoreBodyMB":
+		ctx.config.MaxRestoreBodyMB = cfg.MaxRestoreBodyMB
+	case "RateLimits", "MaxConcurrentBackups":
+		// limits start afresh, requests in flight release slots of the replaced limiters
+		ctx.config.RateLimits = cfg.RateLimits
+		ctx.config.MaxConcurrentBackups = cfg.MaxConcurrentBackups
+		ctx.limiters = newRateLimiters(&ctx.config)
+	default:
+		return fmt.Errorf("setting %s is not applied without restart", setting)
+	}
+	return nil
+}
+
+// storesReload changes of stores prepared under storesLock, applied outside of it
+type storesReload struct {
+	// reserved in pendingStores until they are opened
+	added []Store
+	// already removed from stores, shut down once storesLock is released
+	removed      []*CoreStores
+	reconfigured []reconfiguredStore
+}
+
+type reconfiguredStore struct {
+	store   *CoreStores
+	cfg     Store
+	applied []string
+}
+
+// prepareReload applies changed settings and prepares changes of stores, taking storesLock only for swapping them
+// stores added to configuration file are reserved, removed stores are taken out of stores and configuration
+// stores created at runtime are left untouched, failing setting refuses changes of stores
+func (ctx *Context) prepareReload(cfg *Config, result *reloadResult) (storesReload, error) {
+	ctx.storesLock.Lock()
+	defer ctx.storesLock.Unlock()
+
+	applied, refused := splitSettings(changedFields(configSettings(ctx.config), configSettings(*cfg)), liveSettings)
+	for _, setting := range refused {
+		result.Refused = append(result.Refused, fmt.Sprintf("changing %s requires restart", setting))
+	}
+	var reload storesReload
+	for _, setting := range applied {
+		if err := ctx.applySetting(setting, cfg); err != nil {
+			return reload, fmt.Errorf("changing %s: %v", setting, err)
+		}
+		result.Applied = append(result.Applied, fmt.Sprintf("changed %s", setting))
+	}
+
+	configured := make(map[string]bool)
+	for _, cfgStore := range cfg.Stores {
+		if cfgStore.Runtime {
+			continue
+		}
+		configured[cfgStore.Name] = true
+
+		index, ok := ctx.config.findStore(cfgStore.Name)
+		if !ok {
+			if err := ctx.checkNewStore(cfgStore); err != nil {
+				result.Refused = append(result.Refused, fmt.Sprintf("adding store %s: %v", cfgStore.Name, err))
+				continue
+			}
+			ctx.pendingStores[cfgStore.Name] = cfgStore
+			reload.added = append(reload.added, cfgStore)
+			continue
+		}
+
+		applied, refused := splitSettings(changedFields(ctx.config.Stores[index], cfgStore), liveStoreSettings)
+		if len(refused) > 0 {
+			result.Refused = append(result.Refused, fmt.Sprintf("changing %s of store %s requires restart", strings.Join(refused, ", "), cfgStore.Name))
+			continue
+		}
+		if len(applied) == 0 {
+			continue
+		}
+		ctx.config.Stores[index] = cfgStore
+		if store, ok := ctx.stores[cfgStore.Name]; ok {
+			reload.reconfigured = append(reload.reconfigured, reconfiguredStore{store: store, cfg: cfgStore, applied: applied})
+		}
+	}
+
+	remaining := make([]Store, 0, len(ctx.config.Stores))
+	for _, cfgStore := range ctx.config.Stores {
+		if cfgStore.Runtime || configured[cfgStore.Name] {
+			remaining = append(remaining, cfgStore)
+			continue
+		}
+		if store, ok := ctx.stores[cfgStore.Name]; ok {
+			delete(ctx.stores, cfgStore.Name)
+			reload.removed = append(reload.removed, store)
+		}
+		result.Applied = append(result.Applied, fmt.Sprintf("removed store %s, its files are kept", cfgStore.Name))
+	}
+	ctx.config.Stores = remaining
+	return reload, nil
+}
+
+// reloadStores restarts sync and replication of changed stores, shuts down removed stores keeping their files
+// and opens added stores, taking storesLock only to add them to stores
+// added stores failing to open are refused, failures shutting down removed stores are returned
+func (ctx *Context) reloadStores(reload storesReload, result *reloadResult) error {
+	for _, reconfigured := range reload.reconfigured {
+		ctx.reconfigureStore(reconfigured.store, reconfigured.cfg)
+		result.Applied = append(result.Applied, fmt.Sprintf("changed %s of store %s", strings.Join(reconfigured.applied, ", "), reconfigured.cfg.Name))
+	}
+
+	// requests which looked up a removed store fail once it is shutdown
+	var errs []error
+	for _, store := range reload.removed {
+		if err := closeStore(store); err != nil {
+			errs = append(errs, fmt.Errorf("shutting down removed store %s: %v", store.config.Name, err))
+		}
+	}
+
+	for _, cfg := range reload.added {
+		store, err := ctx.openStore(cfg)
+
+		ctx.storesLock.Lock()
+		delete(ctx.pendingStores, cfg.Name)
+		if err == nil {
+			ctx.stores[cfg.Name] = store
+			ctx.config.Stores = append(ctx.config.Stores, cfg)
+		}
+		ctx.storesLock.Unlock()
+
+		if err != nil {
+			closeStore(store)
+			result.Refused = append(result.Refused, fmt.Sprintf("adding store %s: %v", cfg.Name, err))
+			continue
+		}
+		result.Applied = append(result.Applied, fmt.Sprintf("added store %s", cfg.Name))
+	}
+	return errors.Join(errs...)
+}
+
+// reloadConfigHandler reloads configuration file, returning changes applied and refused
+func (ctx *Context) reloadConfigHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	result, err := ctx.reloadConfig()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	jsRes, err := json.Marshal(result)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
@@ -0,0 +1,225 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+- aggregate:
+    SyncInterval : 1
+    Aggregate:
+      - http://127.0.0.1:1/v1/store/missing
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	const baseURL string = "http://127.0.0.1:8080/v1"
+	if err := postStore(baseURL+"/store/local/update", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// add a store, point aggregate store at local store and attempt changes requiring restart
+	buf = []byte(`
+Port : 8081
+LogLevel : debug
+Stores :
+- local:
+    Backup : BoltDB
+    BackupDir : ./reloadtest
+- aggregate:
+    SyncInterval : 1
+    Aggregate:
+      - http://127.0.0.1:8080/v1/store/local
+- added:
+`)
+	defer os.RemoveAll("./reloadtest")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := http.Post(baseURL+"/config/reload", "application/json", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var result reloadResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+
+	refused := strings.Join(result.Refused, "\n")
+	if !strings.Contains(refused, "changing Port requires restart") || !strings.Contains(refused, "changing Backup, Backupdir of store local requires restart") {
+		t.Errorf("Expected port and backend changes refused, found %+v", result)
+	}
+	if ctx.logLevel.Level().String() != "DEBUG" {
+		t.Errorf("Expected log level changed to debug, found %s", ctx.logLevel.Level())
+	}
+
+	if err := postStore(baseURL+"/store/added/update", []byte(`{"m2": {"num": "6.13"}}`)); err != nil {
+		t.Errorf("Expected added store opened, found %v", err)
+	}
+	var stats storeStats
+	if err := getJSON(baseURL+"/store/local/stats", &stats); err != nil || len(stats.Backup) > 0 {
+		t.Errorf("Expected local store kept without backup, found %+v, %v", stats, err)
+	}
+
+	time.Sleep(2 * time.Second)
+	keys, err := queryStoreKeys(baseURL+"/store/aggregate/query", []byte(`{"num": "6.13"}`))
+	if err != nil || len(keys) != 1 || keys[0] != "m1" {
+		t.Errorf("Expected aggregate store synced from new aggregate url, found %v, %v", keys, err)
+	}
+
+	// removing store from watched configuration file shuts it down
+	buf = []byte(`
+Port : 8080
+Stores :
+- local:
+- aggregate:
+    SyncInterval : 1
+    Aggregate:
+      - http://127.0.0.1:8080/v1/store/local
+`)
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	if status, err := requestStatus("POST", baseURL+"/store/added/query", []byte(`{"num": "6.13"}`)); err != nil || status != http.StatusBadRequest {
+		t.Errorf("Expected removed store not found, found %d, %v", status, err)
+	}
+	if ctx.logLevel.Level().String() != "INFO" {
+		t.Errorf("Expected log level reverted to info, found %s", ctx.logLevel.Level())
+	}
+}
+
+func TestHealthDuringReconfigure(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- aggregate:
+    SyncInterval : 1
+    Aggregate:
+      - http://127.0.0.1:1/v1/store/missing
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	// health reads the syncer replaced by reconfiguring the store
+	store, _ := ctx.store("aggregate")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			ctx.reconfigureStore(store, store.settings())
+		}
+	}()
+	for {
+		recorder := httptest.NewRecorder()
+		ctx.HealthCheckHandler(recorder, httptest.NewRequest("GET", "/v1/health", nil), nil)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected health served during reconfigure, found %d", recorder.Code)
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+func TestReloadOwnConfig(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	// reading another configuration file doesn't change what this context reloads
+	buf = []byte(`
+Port : 8081
+LogLevel : debug
+Stores :
+- other:
+`)
+	defer os.Remove("./otherconfig.yml")
+	if err := ioutil.WriteFile("./otherconfig.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	var other Config
+	if err := other.Initialize("otherconfig", "."); err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := ctx.reloadConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result.Applied) != 0 || len(result.Refused) != 0 {
+		t.Errorf("Expected own configuration reloaded unchanged, found applied %v, refused %v", result.Applied, result.Refused)
+	}
+}
+
+func TestApplySettingErrors(t *testing.T) {
+	ctx := &Context{}
+	ctx.config.LogLevel = "info"
+
+	if err := ctx.applySetting("LogLevel", &Config{LogLevel: "loud"}); err == nil || ctx.config.LogLevel != "info" {
+		t.Errorf("Expected invalid log level refused, found %v, %s", err, ctx.config.LogLevel)
+	}
+	if err := ctx.applySetting("Port", &Config{Port: "8081"}); err == nil {
+		t.Error("Expected setting requiring restart refused")
+	}
+}
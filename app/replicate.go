@@ -0,0 +1,249 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+)
+
+// replicateRetryInterval initial backoff pushing to a failing downstream store
+const replicateRetryInterval = 1 * time.Second
+
+// replicateRequest pushed to replicate endpoint of downstream stores
+// with full the changes are the complete set of associations reported by source
+type replicateRequest struct {
+	Source  string        `json:"source"`
+	Full    bool          `json:"full"`
+	Changes []core.Change `json:"changes"`
+}
+
+// replicaTarget changes pending to be pushed to a single downstream store
+type replicaTarget struct {
+	url        string
+	pending    []core.Change
+	resync     bool
+	generation int
+	wakeup     chan struct{}
+}
+
+// replicator pushes committed changes of a store to downstream stores
+// every target is served by its own goroutine pushing pending changes in batches
+// and retrying with backoff, when pending changes overflow the queue they are
+// dropped and the complete store is pushed instead, same as on startup
+type replicator struct {
+	store      *CoreStores
+	source     string
+	client     *http.Client
+	token      string
+	batchSize  int
+	queueSize  int
+	maxBackoff time.Duration
+	targets    []*replicaTarget
+	lock       sync.Mutex
+	running    sync.WaitGroup
+	reqCtx     context.Context
+	cancel     context.CancelFunc
+}
+
+func newReplicator(store *CoreStores, cfg Store, source string, transport http.RoundTripper) *replicator {
+	if cfg.ReplicateBatchSize < 1 {
+		cfg.ReplicateBatchSize = 1
+	}
+	r := &replicator{
+		store:      store,
+		source:     source,
+		client:     &http.Client{Transport: transport, Timeout: time.Duration(cfg.SyncTimeoutSec) * time.Second},
+		token:      cfg.ReplicateToken,
+		batchSize:  cfg.ReplicateBatchSize,
+		queueSize:  cfg.ReplicateQueueSize,
+		maxBackoff: time.Duration(cfg.SyncMaxBackoffSec) * time.Second,
+	}
+	r.reqCtx, r.cancel = context.WithCancel(context.Background())
+
+	for _, targetURL := range cfg.ReplicateURLs {
+		// downstream stores start with the complete store
+		r.targets = append(r.targets, &replicaTarget{url: targetURL, resync: true, wakeup: make(chan struct{}, 1)})
+	}
+	return r
+}
+
+// start pushing to every target
+func (r *replicator) start() {
+	for _, target := range r.targets {
+		r.running.Add(1)
+		go r.run(target)
+		r.signal(target)
+	}
+}
+
+// stop pushing, pending changes are dropped
+func (r *replicator) stop() {
+	r.cancel()
+	r.running.Wait()
+}
+
+// enqueue committed changes for every target
+func (r *replicator) enqueue(changes []core.Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, target := range r.targets {
+		if target.resync {
+			// complete store will be pushed, which includes these changes
+			continue
+		}
+		if len(target.pending)+len(changes) > r.queueSize {
+			slog.Warn("replication queue overflowed, resyncing complete store", "url", target.url, "queue_size", r.queueSize)
+			target.pending = nil
+			target.resync = true
+			target.generation++
+		} else {
+			target.pending = append(target.pending, changes...)
+		}
+		r.signal(target)
+	}
+}
+
+func (r *replicator) signal(target *replicaTarget) {
+	select {
+	case target.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replicator) run(target *replicaTarget) {
+	defer r.running.Done()
+	failures := 0
+	for {
+		select {
+		case <-r.reqCtx.Done():
+			return
+		case <-target.wakeup:
+		}
+
+		for {
+			request, generation, ok := r.nextBatch(target)
+			if !ok {
+				break
+			}
+
+			if err := r.push(target.url, request); err != nil {
+				r.retry(target, request, generation)
+				failures++
+				backoff := syncBackoff(replicateRetryInterval, r.maxBackoff, failures)
+				slog.Error("error replicating", "url", target.url, "failures", failures, "retry_in", backoff.String(), "error", err)
+				select {
+				case <-r.reqCtx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				continue
+			}
+
+			failures = 0
+			r.ack(target, request, generation)
+		}
+	}
+}
+
+// nextBatch returns the next request to push to target, either complete store or pending changes
+func (r *replicator) nextBatch(target *replicaTarget) (replicateRequest, int, bool) {
+	r.lock.Lock()
+	if target.resync {
+		// changes committed from now on are pushed after the complete store
+		target.resync = false
+		target.pending = nil
+		target.generation++
+		generation := target.generation
+		r.lock.Unlock()
+
+		keyPropStore, err := r.store.primary.Serialize()
+		if err != nil {
+			// retried along with the next committed changes
+			slog.Error("error serializing store for replication", "url", target.url, "error", err)
+			r.retry(target, replicateRequest{Full: true}, generation)
+			return replicateRequest{}, 0, false
+		}
+
+		changes := make([]core.Change, 0)
+		for property, keys := range keyPropStore {
+			for _, key := range keys {
+				changes = append(changes, core.Change{Op: core.ChangeAdd, Property: property, Key: key})
+			}
+		}
+		return replicateRequest{Source: r.source, Full: true, Changes: changes}, generation, true
+	}
+	defer r.lock.Unlock()
+
+	if len(target.pending) == 0 {
+		return replicateRequest{}, 0, false
+	}
+
+	size := len(target.pending)
+	if size > r.batchSize {
+		size = r.batchSize
+	}
+	changes := make([]core.Change, size)
+	copy(changes, target.pending)
+	return replicateRequest{Source: r.source, Changes: changes}, target.generation, true
+}
+
+// ack removes pushed changes, unless target was resynced meanwhile
+func (r *replicator) ack(target *replicaTarget, request replicateRequest, generation int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if request.Full || generation != target.generation {
+		return
+	}
+	target.pending = target.pending[len(request.Changes):]
+}
+
+// retry a failed complete store push, pending changes stay queued
+func (r *replicator) retry(target *replicaTarget, request replicateRequest, generation int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if request.Full && generation == target.generation {
+		target.resync = true
+	}
+}
+
+func (r *replicator) push(targetURL string, request replicateRequest) error {
+	jsReq, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", targetURL+"/replicate", bytes.NewBuffer(jsReq))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	setAuthorization(httpReq, r.token)
+
+	httpResp, err := r.client.Do(httpReq.WithContext(r.reqCtx))
+	if err != nil {
+		return err
+	}
+
+	bodyBytes, _ := ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", targetURL, httpResp.Status, string(bodyBytes))
+	}
+	return nil
+}
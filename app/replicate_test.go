@@ -0,0 +1,115 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+)
+
+func TestReplicateToAggregate(t *testing.T) {
+	buf1 := []byte(`
+Port : 8080
+Stores :
+- aggregate:
+`)
+
+	buf2 := []byte(`
+Port : 8081
+Stores :
+- local:
+    ReplicateBatchSize: 1
+    ReplicateSource: http://127.0.0.1:8081/v1/store/local
+    Replicate:
+    - http://127.0.0.1:8080/v1/store/aggregate
+`)
+
+	defer os.Remove("./config1.yml")
+	defer os.Remove("./config2.yml")
+	if err := ioutil.WriteFile("./config1.yml", buf1, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile("./config2.yml", buf2, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config1", "./config1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	ctx2, err := CreateContext("config2", "./config2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx2)
+
+	time.Sleep(1 * time.Second)
+
+	if err := postStore("http://127.0.0.1:8081/v1/store/local/update", []byte(`{"m1": {"num": "6.13"}, "m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := postStore("http://127.0.0.1:8081/v1/store/local/remove", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// pushed changes should arrive well before any sync interval
+	time.Sleep(500 * time.Millisecond)
+
+	res, err := queryStoreKeys("http://127.0.0.1:8080/v1/store/aggregate/query", []byte(`{"num": "6.13"}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Log("Store returned", res, "Expect", []string{"m2"})
+
+	if len(res) != 1 || res[0] != "m2" {
+		t.Errorf("Expected pushed changes to be replicated to aggregate, found %v", res)
+	}
+}
+
+func TestReplicateQueueOverflow(t *testing.T) {
+	store := &CoreStores{}
+	r := newReplicator(store, Store{ReplicateURLs: []string{"http://127.0.0.1:1"}, ReplicateBatchSize: 10, ReplicateQueueSize: 2}, "source", nil)
+	target := r.targets[0]
+
+	// complete store is pending on startup, changes are included in it
+	r.enqueue(parseChanges(t, `{"m1": {"num": "6.13"}}`))
+	if len(target.pending) != 0 || !target.resync {
+		t.Errorf("Expected changes to be covered by pending resync, found %v", target.pending)
+		return
+	}
+
+	target.resync = false
+	r.enqueue(parseChanges(t, `{"m1": {"num": "6.13"}, "m2": {"num": "6.13"}}`))
+	if len(target.pending) != 2 {
+		t.Errorf("Expected 2 pending changes, found %v", target.pending)
+		return
+	}
+
+	r.enqueue(parseChanges(t, `{"m3": {"num": "6.13"}}`))
+	if len(target.pending) != 0 || !target.resync {
+		t.Errorf("Expected overflow to drop pending changes and resync, found %v", target.pending)
+	}
+}
+
+func parseChanges(t *testing.T, update string) []core.Change {
+	changes, err := core.ParseUpdate([]byte(update), core.ChangeAdd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
@@ -2,11 +2,20 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 )
 
+// respondWithError including request id, message is logged with the request
 func respondWithError(w http.ResponseWriter, code int, message string) {
-	response, _ := json.Marshal(map[string]string{"status": "error", "message": message})
+	if recorder, ok := w.(*responseRecorder); ok {
+		recorder.err = message
+	}
+	errResponse := map[string]string{"status": "error", "message": message}
+	if requestID := w.Header().Get(requestIDHeader); len(requestID) > 0 {
+		errResponse["requestId"] = requestID
+	}
+	response, _ := json.Marshal(errResponse)
 	respondJSON(w, code, response)
 }
 
@@ -20,3 +29,12 @@ func respondJSON(w http.ResponseWriter, code int, response []byte) {
 	w.WriteHeader(code)
 	w.Write(response)
 }
+
+// readErrorStatus of reading request body, too large when it exceeds the body limit
+func readErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -11,21 +11,31 @@ type Route struct {
 	Method   string
 	RouteURI string
 	Handler  httprouter.Handle
+	// scope required on store of the request when credentials are configured
+	Scope string
 }
 
 // NewAppRouter registers multiple logged routes
+// health and pprof are registered along with app routes unless served by a separate admin listener
 func NewAppRouter(ctx *Context) http.Handler {
 	router := httprouter.New()
-	// Register default routes, which typically provides healtcheck and prof
-	for _, route := range defaultRoutes {
-		//log.Println("Registering Default Route", APIVERSION+route.RouteURI)
-		router.Handle(route.Method, APIVERSION+route.RouteURI, LoggerMiddleware(route.Handler))
-	}
-
-	for _, route := range ctx.appRoutes {
-		//log.Println("Registering App Route", APIVERSION+route.RouteURI)
-		router.Handle(route.Method, APIVERSION+route.RouteURI, LoggerMiddleware(route.Handler))
+	if len(ctx.config.AdminListen) == 0 {
+		ctx.handleRoutes(router, ctx.adminRoutes)
 	}
+	ctx.handleRoutes(router, ctx.appRoutes)
+	return http.Handler(router)
+}
 
+// NewAdminRouter registers health and pprof routes of the admin listener
+func NewAdminRouter(ctx *Context) http.Handler {
+	router := httprouter.New()
+	ctx.handleRoutes(router, ctx.adminRoutes)
 	return http.Handler(router)
 }
+
+func (ctx *Context) handleRoutes(router *httprouter.Router, routes []Route) {
+	for _, route := range routes {
+		handler := ctx.AuthMiddleware(route.Scope, ctx.BackupLimitMiddleware(route, ctx.BodyLimitMiddleware(route.RouteURI, route.Handler)))
+		router.Handle(route.Method, APIVERSION+route.RouteURI, LoggerMiddleware(ctx.MetricsMiddleware(route.RouteURI, ctx.RateLimitMiddleware(route, handler))))
+	}
+}
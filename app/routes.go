@@ -1,26 +1,47 @@
 package app
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/awesomenix/keypropstore/core"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (ctx *Context) registerRoutes() {
+	// Register default routes, which typically provides healtcheck and prof
+	ctx.adminRoutes = append([]Route{Route{"GET", "/health", ctx.HealthCheckHandler, scopeNone}}, defaultRoutes...)
 	ctx.appRoutes = []Route{
-		Route{"POST", "/store/:store/query", ctx.queryStore},
-		Route{"POST", "/store/:store/update", ctx.updateStore},
-		Route{"GET", "/store/:store/backup", ctx.backupStore},
-		Route{"POST", "/store/:store/restore", ctx.restoreStore},
+		Route{"GET", "/metrics", ctx.metricsHandler, scopeQuery},
+		Route{"GET", "/stores", ctx.listStores, scopeAdmin},
+		Route{"POST", "/stores", ctx.addStore, scopeAdmin},
+		Route{"DELETE", "/stores/:store", ctx.dropStore, scopeAdmin},
+		Route{"POST", "/config/reload", ctx.reloadConfigHandler, scopeAdmin},
+		Route{"POST", "/store/:store/query", ctx.queryStore, scopeQuery},
+		Route{"POST", "/store/:store/update", ctx.updateStore, scopeUpdate},
+		Route{"GET", "/store/:store/backup", ctx.backupStore, scopeBackup},
+		Route{"POST", "/store/:store/restore", ctx.restoreStore, scopeRestore},
+		Route{"GET", "/store/:store/backupqueue", ctx.backupQueueStore, scopeQuery},
+		Route{"POST", "/store/:store/remove", ctx.removeStore, scopeUpdate},
+		Route{"GET", "/store/:store/changes", ctx.changesStore, scopeBackup},
+		Route{"GET", "/store/:store/sync", ctx.syncStatusStore, scopeQuery},
+		Route{"GET", "/store/:store/memory", ctx.memoryStore, scopeQuery},
+		Route{"GET", "/store/:store/stats", ctx.statsStore, scopeQuery},
+		Route{"POST", "/store/:store/replicate", ctx.replicateStore, scopeUpdate},
+		Route{"POST", "/store/:store/watch", ctx.watchStore, scopeQuery},
+		Route{"GET", "/store/:store/snapshots", ctx.listSnapshots, scopeQuery},
+		Route{"POST", "/store/:store/snapshots", ctx.createSnapshot, scopeAdmin},
+		Route{"POST", "/store/:store/snapshots/:snapshot/restore", ctx.restoreSnapshotStore, scopeRestore},
 	}
 }
 
 func (ctx *Context) queryStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
 	storeName := httpParams.ByName("store")
-	store, ok := ctx.stores[storeName]
+	store, ok := ctx.store(storeName)
 
 	if !ok {
 		err := fmt.Sprintf("invalid or store %s not found", storeName)
@@ -30,7 +51,8 @@ func (ctx *Context) queryStore(w http.ResponseWriter, r *http.Request, httpParam
 
 	propQuery, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-
+		respondWithError(w, readErrorStatus(err), err.Error())
+		return
 	}
 
 	if err := r.Body.Close(); err != nil {
@@ -38,7 +60,9 @@ func (ctx *Context) queryStore(w http.ResponseWriter, r *http.Request, httpParam
 		return
 	}
 
+	start := time.Now()
 	jsRes, err := core.QueryStore(store.primary, propQuery)
+	metrics.observeStoreOp(store.primary, "query", start)
 
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
@@ -50,7 +74,7 @@ func (ctx *Context) queryStore(w http.ResponseWriter, r *http.Request, httpParam
 
 func (ctx *Context) updateStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
 	storeName := httpParams.ByName("store")
-	store, ok := ctx.stores[storeName]
+	store, ok := ctx.store(storeName)
 
 	if !ok {
 		err := fmt.Sprintf("invalid or store %s not found", storeName)
@@ -59,38 +83,121 @@ func (ctx *Context) updateStore(w http.ResponseWriter, r *http.Request, httpPara
 	}
 
 	jsReq, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, readErrorStatus(err), err.Error())
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	changes, err := core.ParseUpdate(jsReq, core.ChangeAdd)
+
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	if err := store.applyChanges(changes); err != nil {
+		respondWithError(w, writeErrorStatus(err), err.Error())
+		return
+	}
+
+	respondOK(w, "ok")
+}
+
+func (ctx *Context) removeStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	jsReq, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, readErrorStatus(err), err.Error())
+		return
+	}
+
 	if err := r.Body.Close(); err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err = core.UpdateStore(store.primary, jsReq)
+	changes, err := core.ParseUpdate(jsReq, core.ChangeRemove)
 
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if store.backup != nil {
-		err = core.UpdateStore(store.backup, jsReq)
+	if err := store.applyChanges(changes); err != nil {
+		respondWithError(w, writeErrorStatus(err), err.Error())
+		return
+	}
+
+	respondOK(w, "ok")
+}
+
+// changesStore returns changes after since cursor, upto optional limit
+// without since returns only the current cursor, used before a full sync
+// an invalid or expired cursor is reported as gone, caller should perform full sync
+func (ctx *Context) changesStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	since := r.URL.Query().Get("since")
+	if len(since) == 0 {
+		jsRes, _ := json.Marshal(changesResponse{Cursor: store.changes.Cursor(), Changes: []core.Change{}})
+		respondJSON(w, http.StatusOK, jsRes)
+		return
+	}
 
-		if err != nil {
+	limit := 0
+	if limitParam := r.URL.Query().Get("limit"); len(limitParam) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(limitParam); err != nil {
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 	}
 
-	respondOK(w, "ok")
+	changes, cursor, err := store.changes.Since(since, limit)
+
+	if err == core.ErrCursorInvalid {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	jsRes, err := json.Marshal(changesResponse{Cursor: cursor, Changes: changes})
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
 }
 
 func (ctx *Context) backupStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
 	storeName := httpParams.ByName("store")
-	store, ok := ctx.stores[storeName]
+	store, ok := ctx.store(storeName)
 
 	if !ok {
 		err := fmt.Sprintf("invalid or store %s not found", storeName)
@@ -98,7 +205,9 @@ func (ctx *Context) backupStore(w http.ResponseWriter, r *http.Request, httpPara
 		return
 	}
 
+	start := time.Now()
 	jsRes, err := core.SerializeStore(store.primary)
+	metrics.observeStoreOp(store.primary, "serialize", start)
 
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
@@ -110,7 +219,7 @@ func (ctx *Context) backupStore(w http.ResponseWriter, r *http.Request, httpPara
 
 func (ctx *Context) restoreStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
 	storeName := httpParams.ByName("store")
-	store, ok := ctx.stores[storeName]
+	store, ok := ctx.store(storeName)
 
 	if !ok {
 		err := fmt.Sprintf("invalid or store %s not found", storeName)
@@ -120,7 +229,7 @@ func (ctx *Context) restoreStore(w http.ResponseWriter, r *http.Request, httpPar
 
 	jsReq, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithError(w, readErrorStatus(err), err.Error())
 		return
 	}
 
@@ -129,21 +238,187 @@ func (ctx *Context) restoreStore(w http.ResponseWriter, r *http.Request, httpPar
 		return
 	}
 
-	err = core.DeSerializeStore(store.primary, jsReq)
+	changes, err := core.ParseSerialized(jsReq)
 
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if store.backup != nil {
-		err = core.DeSerializeStore(store.backup, jsReq)
+	if err := store.applyChanges(changes); err != nil {
+		respondWithError(w, writeErrorStatus(err), err.Error())
+		return
+	}
 
-		if err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+	respondOK(w, "ok")
+}
+
+// syncStatusStore returns sync status of every aggregate url of the store
+func (ctx *Context) syncStatusStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	statuses := make([]aggregateURLStatus, 0)
+	if syncer := store.aggregateSyncer(); syncer != nil {
+		statuses = syncer.status(time.Now())
+	}
+
+	jsRes, err := json.Marshal(statuses)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
+
+// memoryStore returns memory used by primary in memory store
+func (ctx *Context) memoryStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	primary, ok := store.primary.(*core.InMemoryStore)
+	if !ok {
+		err := fmt.Sprintf("primary store of %s does not report memory usage", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	jsRes, err := json.Marshal(primary.MemoryUsage())
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
+
+// defaultLargestPostingLists number of largest posting lists reported by stats
+const defaultLargestPostingLists int = 10
+
+// storeStats size of primary store along with disk usage and lag of backup store
+type storeStats struct {
+	core.StoreStats
+	Backup           string `json:"backup,omitempty"`
+	DiskBytes        int64  `json:"diskBytes"`
+	BackupQueueDepth int    `json:"backupQueueDepth"`
+	BackupLagMs      int64  `json:"backupLagMs"`
+}
+
+// statsStore returns size of store, upto optional largest posting lists
+func (ctx *Context) statsStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	largest := defaultLargestPostingLists
+	if largestParam := r.URL.Query().Get("largest"); len(largestParam) > 0 {
+		var err error
+		if largest, err = strconv.Atoi(largestParam); err != nil || largest < 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid largest %s", largestParam))
+			return
+		}
+	}
+
+	primary, ok := store.primary.(core.StatsStore)
+	if !ok {
+		err := fmt.Sprintf("primary store of %s does not report stats", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var stats storeStats
+	var err error
+	if stats.StoreStats, err = primary.Stats(largest); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	stats.Backup = store.settings().Backup
+	// tiered primary store is disk backed itself
+	disk, ok := store.backup.(core.DiskStore)
+	if !ok {
+		disk, ok = store.primary.(core.DiskStore)
+	}
+	if ok {
+		if stats.DiskBytes, err = disk.DiskSize(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 	}
 
+	if store.writeBehind != nil {
+		status := store.writeBehind.status(time.Now())
+		stats.BackupQueueDepth, stats.BackupLagMs = status.Depth, status.LagMs
+	}
+
+	jsRes, err := json.Marshal(stats)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
+
+// replicateStore applies changes pushed by an upstream store
+// changes are tracked along with the upstream source, same as aggregate urls
+func (ctx *Context) replicateStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	jsReq, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, readErrorStatus(err), err.Error())
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var request replicateRequest
+	if err := json.Unmarshal(jsReq, &request); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(request.Source) == 0 {
+		respondWithError(w, http.StatusBadRequest, "replication source is required")
+		return
+	}
+
+	if err := store.applySourceChanges(request.Source, request.Changes, request.Full); err != nil {
+		respondWithError(w, writeErrorStatus(err), err.Error())
+		return
+	}
+
 	respondOK(w, "ok")
 }
@@ -0,0 +1,343 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+	"github.com/julienschmidt/httprouter"
+)
+
+const snapshotPrefix string = "snapshot-"
+const snapshotSuffix string = ".json"
+
+// snapshotTimeFormat sorts lexically in time order
+const snapshotTimeFormat string = "20060102T150405.000000000Z"
+
+// snapshotInfo listed by snapshots endpoint, newest first
+type snapshotInfo struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// snapshotter writes point in time copies of the primary store to disk
+// periodically when interval is configured and on demand, keeping the newest retain snapshots
+type snapshotter struct {
+	store    *CoreStores
+	dir      string
+	interval time.Duration
+	retain   int
+	lock     sync.Mutex
+	stopped  chan struct{}
+	running  sync.WaitGroup
+}
+
+func newSnapshotter(store *CoreStores, cfg Store) *snapshotter {
+	dir := filepath.Join(cfg.Backupdir, "snapshots")
+	if len(cfg.Backupdir) == 0 {
+		dir = filepath.Join("snapshots", cfg.Name)
+	}
+	return &snapshotter{
+		store:    store,
+		dir:      dir,
+		interval: time.Duration(cfg.SnapshotIntervalMin) * time.Minute,
+		retain:   cfg.SnapshotRetain,
+		stopped:  make(chan struct{}),
+	}
+}
+
+// start periodic snapshots if interval is configured
+func (s *snapshotter) start() {
+	if s.interval <= 0 {
+		return
+	}
+	s.running.Add(1)
+	go s.run()
+}
+
+func (s *snapshotter) stop() {
+	close(s.stopped)
+	s.running.Wait()
+}
+
+func (s *snapshotter) run() {
+	defer s.running.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+			if _, err := s.snapshot(); err != nil {
+				slog.Error("error writing snapshot", "dir", s.dir, "error", err)
+			}
+		}
+	}
+}
+
+// snapshot writes serialized primary store atomically and prunes old snapshots
+func (s *snapshotter) snapshot() (snapshotInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	jsStore, err := core.SerializeStore(s.store.primary)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return snapshotInfo{}, err
+	}
+
+	now := time.Now().UTC()
+	info := snapshotInfo{Name: snapshotPrefix + now.Format(snapshotTimeFormat) + snapshotSuffix, Time: now, Size: int64(len(jsStore))}
+
+	tmpPath := filepath.Join(s.dir, info.Name+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	if _, err := file.Write(jsStore); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return snapshotInfo{}, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return snapshotInfo{}, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return snapshotInfo{}, err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, info.Name)); err != nil {
+		return snapshotInfo{}, err
+	}
+
+	s.prune()
+	return info, nil
+}
+
+// prune snapshots beyond retention, called with lock held
+func (s *snapshotter) prune() {
+	if s.retain <= 0 {
+		return
+	}
+	snapshots, err := s.list()
+	if err != nil {
+		return
+	}
+	for i := s.retain; i < len(snapshots); i++ {
+		if err := os.Remove(filepath.Join(s.dir, snapshots[i].Name)); err != nil {
+			slog.Error("error removing snapshot", "snapshot", snapshots[i].Name, "error", err)
+		}
+	}
+}
+
+// list snapshots newest first
+func (s *snapshotter) list() ([]snapshotInfo, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []snapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]snapshotInfo, 0)
+	for _, file := range files {
+		snapshotTime, ok := parseSnapshotName(file.Name())
+		if !ok || file.IsDir() {
+			continue
+		}
+		snapshots = append(snapshots, snapshotInfo{Name: file.Name(), Time: snapshotTime, Size: file.Size()})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name > snapshots[j].Name })
+	return snapshots, nil
+}
+
+// read snapshot contents as add changes, fails on unknown or corrupt snapshots
+func (s *snapshotter) read(name string) ([]core.Change, error) {
+	if _, ok := parseSnapshotName(name); !ok {
+		return nil, fmt.Errorf("invalid snapshot name %s", name)
+	}
+	jsStore, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return core.ParseSerialized(jsStore)
+}
+
+// latest returns contents of the newest snapshot which could be read, skipping corrupt ones
+func (s *snapshotter) latest() (string, []core.Change, error) {
+	snapshots, err := s.list()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, snapshot := range snapshots {
+		changes, err := s.read(snapshot.Name)
+		if err != nil {
+			slog.Warn("skipping invalid snapshot", "snapshot", snapshot.Name, "error", err)
+			continue
+		}
+		return snapshot.Name, changes, nil
+	}
+	return "", nil, nil
+}
+
+func parseSnapshotName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+		return time.Time{}, false
+	}
+	snapshotTime, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+	return snapshotTime, err == nil
+}
+
+// restoreSnapshot replaces contents of the store with the snapshot
+// only the difference is applied, so backup, change log, replicas and watchers see regular changes
+func (s *CoreStores) restoreSnapshot(snapshot []core.Change) ([]core.Change, error) {
+	if err := core.ValidateChanges(snapshot); err != nil {
+		return nil, err
+	}
+
+	// writes are blocked from reading current contents until the difference is applied,
+	// so concurrent writes are neither lost nor reverted by the restore
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	current, err := s.primary.Serialize()
+	if err != nil {
+		return nil, &storeWriteError{store: "primary", err: err}
+	}
+
+	existing := make(map[core.Change]bool)
+	for property, keys := range current {
+		for _, key := range keys {
+			existing[core.Change{Op: core.ChangeAdd, Property: property, Key: key}] = true
+		}
+	}
+
+	changes := make([]core.Change, 0)
+	for _, change := range snapshot {
+		change.Property = storedProperty(s.primary, change.Property)
+		change.Key = strings.ToLower(change.Key)
+		if existing[change] {
+			delete(existing, change)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	for change := range existing {
+		change.Op = core.ChangeRemove
+		changes = append(changes, change)
+	}
+
+	if len(changes) == 0 {
+		return changes, nil
+	}
+	return changes, s.applyLockedChanges(changes)
+}
+
+// storedProperty normalized the way primary stores it, so it compares with serialized contents of primary
+// in memory stores lowercase properties, tiered stores keep the case of their backing store
+func storedProperty(primary core.Store, property string) string {
+	if _, ok := primary.(*core.TieredStore); ok {
+		return property
+	}
+	return strings.ToLower(property)
+}
+
+func (ctx *Context) createSnapshot(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	info, err := store.snapshotter.snapshot()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	jsRes, err := json.Marshal(info)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
+
+func (ctx *Context) listSnapshots(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	snapshots, err := store.snapshotter.list()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	jsRes, err := json.Marshal(snapshots)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
+
+func (ctx *Context) restoreSnapshotStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	snapshotName := httpParams.ByName("snapshot")
+	snapshot, err := store.snapshotter.read(snapshotName)
+	if os.IsNotExist(err) {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("snapshot %s not found", snapshotName))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	changes, err := store.restoreSnapshot(snapshot)
+	if err != nil {
+		respondWithError(w, writeErrorStatus(err), err.Error())
+		return
+	}
+
+	slog.Info("restored store from snapshot", "store", storeName, "snapshot", snapshotName, "changes", len(changes))
+	respondOK(w, "ok")
+}
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+    BackupDir : ./snapshottest
+    SnapshotInterval : 60
+    SnapshotRetain : 2
+`)
+
+	os.RemoveAll("./snapshottest")
+	defer os.RemoveAll("./snapshottest")
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(1 * time.Second)
+
+	const storeURL string = "http://127.0.0.1:8080/v1/store/local"
+	if err := postStore(storeURL+"/update", []byte(`{"m1": {"num": "6.13"}, "m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+
+	// retention keeps only the newest snapshots
+	var snapshot snapshotInfo
+	for i := 0; i < 3; i++ {
+		if err := postJSON(storeURL+"/snapshots", nil, &snapshot); err != nil {
+			t.Error(err)
+			DeleteContext(ctx)
+			return
+		}
+	}
+
+	var snapshots []snapshotInfo
+	if err := getJSON(storeURL+"/snapshots", &snapshots); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	if len(snapshots) != 2 || snapshots[0].Name != snapshot.Name {
+		t.Errorf("Expected newest 2 snapshots starting with %s, found %v", snapshot.Name, snapshots)
+	}
+
+	if err := postStore(storeURL+"/remove", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	if err := postStore(storeURL+"/update", []byte(`{"m3": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+
+	if err := postStore(storeURL+"/snapshots/"+snapshot.Name+"/restore", nil); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+
+	testQueryKeys(storeURL+"/query", []string{"m1", "m2"}, t)
+
+	if err := postStore(storeURL+"/snapshots/snapshot-missing.json/restore", nil); err == nil {
+		t.Errorf("Expected restoring unknown snapshot to fail")
+	}
+
+	// restart restores from the newest snapshot
+	if err := postStore(storeURL+"/update", []byte(`{"m4": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	if err := postJSON(storeURL+"/snapshots", nil, &snapshot); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	DeleteContext(ctx)
+
+	ctx, err = CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	testQueryKeys(storeURL+"/query", []string{"m1", "m2", "m4"}, t)
+}
+
+func TestSnapshotNotRestoredUnconfigured(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+    BackupDir : ./snapshotunconfigured
+`)
+
+	os.RemoveAll("./snapshotunconfigured")
+	defer os.RemoveAll("./snapshotunconfigured")
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(1 * time.Second)
+
+	const storeURL string = "http://127.0.0.1:8080/v1/store/local"
+	if err := postStore(storeURL+"/update", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	var snapshot snapshotInfo
+	if err := postJSON(storeURL+"/snapshots", nil, &snapshot); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	DeleteContext(ctx)
+
+	// snapshots taken on demand are not restored unless snapshots are configured
+	ctx, err = CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	if err := postStore(storeURL+"/update", []byte(`{"m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+	testQueryKeys(storeURL+"/query", []string{"m2"}, t)
+}
+
+func testQueryKeys(url string, expected []string, t *testing.T) {
+	res, err := queryStoreKeys(url, []byte(`{"num": "6.13"}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sort.Strings(res)
+
+	t.Log("Store returned", res, "Expect", expected)
+
+	if len(res) != len(expected) {
+		t.Errorf("Expected %v, found %v", expected, res)
+		return
+	}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("Expected %v, found %v", expected, res)
+			return
+		}
+	}
+}
+
+func TestSnapshotRestoreBlocksWrites(t *testing.T) {
+	primary := &core.InMemoryStore{}
+	core.InitializeStore(primary, nil)
+	store := &CoreStores{primary: primary, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+	if err := store.applyChanges([]core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: "m1"}}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// restore waits for writes in progress, whichever property they change
+	unlock := store.writeLock.lockProperties([]core.Change{{Property: "strs:a"}})
+	done := make(chan error)
+	go func() {
+		_, err := store.restoreSnapshot([]core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: "m2"}})
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Errorf("Expected restore to wait for write in progress")
+		unlock()
+		return
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys, err := primary.Query("num:6.13")
+	if err != nil || len(keys) != 1 || keys[0] != "m2" {
+		t.Errorf("Expected store replaced by snapshot, found %v, %v", keys, err)
+	}
+}
+
+func TestSnapshotRestoreTieredMixedCase(t *testing.T) {
+	os.RemoveAll("./tieredsnapshottest")
+	defer os.RemoveAll("./tieredsnapshottest")
+
+	bolt, err := createStore(Store{Name: "local", Backup: "BoltDB", Backupdir: "./tieredsnapshottest"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	primary := &core.TieredStore{}
+	if err := core.InitializeStore(primary, &core.TieredStoreConfig{Backing: bolt, BudgetBytes: 1 << 20}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer primary.Shutdown()
+	store := &CoreStores{primary: primary, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+	if err := store.applyChanges([]core.Change{{Op: core.ChangeAdd, Property: "OS:Linux", Key: "M1"}}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// snapshot of a tiered store keeps the case of properties, restoring it changes nothing
+	jsStore, err := core.SerializeStore(primary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	snapshot, err := core.ParseSerialized(jsStore)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	changes, err := store.restoreSnapshot(snapshot)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Expected restoring snapshot just taken to change nothing, found %v, %v", changes, err)
+	}
+	if keys, err := primary.Query("OS:Linux"); err != nil || len(keys) != 1 {
+		t.Errorf("Expected mixed case property kept, found %v, %v", keys, err)
+	}
+}
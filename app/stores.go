@@ -1,143 +1,536 @@
 package app
 
 import (
-	"io/ioutil"
-	"log"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/awesomenix/keypropstore/core"
-	"github.com/dgraph-io/badger"
 )
 
+// defaultChangeLogSize number of changes retained for incremental sync
+const defaultChangeLogSize int = 100000
+
 // CoreStores contains primary and optional backup store
+// along with log of changes applied to them
+// and the sources which reported associations to aggregate stores
 type CoreStores struct {
-	primary  core.Store
-	backup   core.Store
-	shutdown chan bool
+	// settings the store was opened with
+	config  Store
+	primary core.Store
+	backup  core.Store
+	changes *core.ChangeLog
+	sources *core.SourceIndex
+	// serializes applying changes reported by sources, so removals are
+	// decided against a consistent view of other sources
+	sourcesLock sync.Mutex
+	// guards settings and aggregate sync, replaced when configuration is reloaded
+	reloadLock  sync.RWMutex
+	syncer      *aggregateSync
+	replicator  *replicator
+	snapshotter *snapshotter
+	// applies changes to backup asynchronously when configured
+	writeBehind *writeBehind
+	// serializes writes of each property to primary and backup store
+	writeLock writeLocks
+	// watchers notified of committed changes
+	subscribersLock sync.Mutex
+	subscribers     map[*changeSubscriber]struct{}
+	shutdown        chan bool
 }
 
-// CreateStore specified in Configuration
-func createStore(storeType, storeDir string) (core.Store, error) {
-	switch storeType {
-	case "InMemory":
-		store := new(core.InMemoryStore)
-		return store, core.InitializeStore(store, nil)
-	case "BadgerDB":
-		opts := badger.DefaultOptions
-		opts.Dir = storeDir
-		opts.ValueDir = storeDir
-		store := new(core.BadgerStore)
-		return store, core.InitializeStore(store, opts)
-	case "BoltDB":
-		os.Mkdir(storeDir, os.ModePerm)
-		storePath := filepath.Join(storeDir, "boltdbstore")
-		opts := &core.BoltStoreConfig{Path: storePath, Mode: 600, Options: nil}
-		store := new(core.BoltStore)
-		return store, core.InitializeStore(store, opts)
+// applyChanges to primary and backup store, recording them in change log
+// changes are applied to both stores or neither, when a store fails
+// the changes already applied are rolled back and a storeWriteError is returned
+// with write behind, backup store is updated asynchronously and never rolled back
+func (s *CoreStores) applyChanges(changes []core.Change) error {
+	if err := core.ValidateChanges(changes); err != nil {
+		return err
+	}
+
+	// serialized per property so rollback never undoes changes applied concurrently, while
+	// changes of other properties proceed concurrently, e.g. to separate shards of the primary
+	unlock := s.writeLock.lockProperties(changes)
+	defer unlock()
+	return s.applyLockedChanges(changes)
+}
+
+// applyLockedChanges to primary and backup store, called with writeLock held for the properties of changes
+func (s *CoreStores) applyLockedChanges(changes []core.Change) error {
+	// each store is reverted by changes based on its own state, backends keep the case of properties
+	var primaryUndo, backupUndo []core.Change
+	if s.backup != nil && s.writeBehind == nil {
+		primaryUndo = undoChanges(s.primary, changes)
+		backupUndo = undoChanges(s.backup, changes)
+	} else if _, ok := s.primary.(*core.TieredStore); ok {
+		// tiered primary writes through to its backing store, which could fail part way
+		primaryUndo = undoChanges(s.primary, changes)
+	}
+
+	// room is reserved in write behind queue before the primary is changed, so writers never
+	// wait for a slow backup store while holding writeLock
+	if s.writeBehind != nil && !s.writeBehind.reserve(len(changes)) {
+		return errBackupQueueFull
+	}
+
+	if applied, err := applyStoreChanges(s.primary, changes); err != nil {
+		rollbackStoreChanges(s.primary, primaryUndo, applied)
+		if s.writeBehind != nil {
+			s.writeBehind.cancel(len(changes))
+		}
+		return &storeWriteError{store: "primary", err: err}
+	}
+
+	if s.writeBehind != nil {
+		s.writeBehind.enqueue(changes)
+	} else if s.backup != nil {
+		if applied, err := applyStoreChanges(s.backup, changes); err != nil {
+			rollbackStoreChanges(s.backup, backupUndo, applied)
+			rollbackStoreChanges(s.primary, primaryUndo, len(changes))
+			return &storeWriteError{store: "backup", err: err}
+		}
+	}
+
+	s.changes.Append(changes)
+
+	if s.replicator != nil {
+		s.replicator.enqueue(changes)
+	}
+
+	s.notify(changes)
+	return nil
+}
+
+// writeLockStripes number of locks properties are hashed to
+const writeLockStripes int = 64
+
+// writeLocks serialize writes of properties hashed to the same stripe, changes of a property are
+// applied, logged, replicated and notified in the same order, changes of different properties commute
+type writeLocks struct {
+	stripes [writeLockStripes]sync.Mutex
+}
+
+// stripe of property, case insensitive like primary stores
+func writeStripe(property string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(property)))
+	return int(hash.Sum32() % uint32(writeLockStripes))
+}
+
+// lockProperties of changes in stripe order, so writers never deadlock, returns unlock
+func (l *writeLocks) lockProperties(changes []core.Change) func() {
+	var locked [writeLockStripes]bool
+	for _, change := range changes {
+		locked[writeStripe(change.Property)] = true
+	}
+	for i := range l.stripes {
+		if locked[i] {
+			l.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := range l.stripes {
+			if locked[i] {
+				l.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+// Lock every stripe, blocking writes of the whole store
+func (l *writeLocks) Lock() {
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+}
+
+// Unlock every stripe
+func (l *writeLocks) Unlock() {
+	for i := range l.stripes {
+		l.stripes[i].Unlock()
 	}
+}
+
+// storeWriteError failure writing to primary or backup store, reported as server error
+type storeWriteError struct {
+	store string
+	err   error
+}
+
+func (e *storeWriteError) Error() string {
+	return fmt.Sprintf("error writing %s store: %v", e.store, e.err)
+}
+
+// writeErrorStatus maps errors applying changes to http status
+func writeErrorStatus(err error) int {
+	if err == errBackupQueueFull {
+		return http.StatusServiceUnavailable
+	}
+	if _, ok := err.(*storeWriteError); ok {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// undoChanges returns for each change the change reverting it in store, based on current state of store
+// changes which would not modify the store are reverted by an empty change
+// undo changes keep property and key as given, so they are normalized by store the same way as changes
+func undoChanges(store core.Store, changes []core.Change) []core.Change {
+	// properties looked up once, updated as changes in the batch are applied
+	state := make(map[string]map[string]bool)
+	undo := make([]core.Change, len(changes))
+
+	for i, change := range changes {
+		// every store lowercases keys
+		key := strings.ToLower(change.Key)
+		keySet, ok := state[change.Property]
+		if !ok {
+			keySet = make(map[string]bool)
+			// missing property has no keys
+			keys, _ := store.Query(change.Property)
+			for _, existing := range keys {
+				keySet[strings.ToLower(existing)] = true
+			}
+			state[change.Property] = keySet
+		}
+
+		switch {
+		case change.Op == core.ChangeAdd && !keySet[key]:
+			undo[i] = core.Change{Op: core.ChangeRemove, Property: change.Property, Key: change.Key}
+			keySet[key] = true
+		case change.Op == core.ChangeRemove && keySet[key]:
+			undo[i] = core.Change{Op: core.ChangeAdd, Property: change.Property, Key: change.Key}
+			delete(keySet, key)
+		}
+	}
+
+	return undo
+}
+
+// applyStoreChanges returns the number of changes applied before failing
+// batch stores apply all of the changes or none
+func applyStoreChanges(store core.Store, changes []core.Change) (int, error) {
+	defer metrics.observeStoreOp(store, "apply", time.Now())
+
+	if batchStore, ok := store.(core.BatchStore); ok {
+		if err := batchStore.ApplyBatch(changes); err != nil {
+			return 0, err
+		}
+		return len(changes), nil
+	}
+
+	for i := range changes {
+		if err := core.ApplyChanges(store, changes[i:i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(changes), nil
+}
+
+// rollbackStoreChanges reverts the first applied changes in reverse order, failures are only logged
+// since the original error is reported to the client, without undo changes nothing is reverted
+func rollbackStoreChanges(store core.Store, undo []core.Change, applied int) {
+	if applied > len(undo) {
+		applied = len(undo)
+	}
+	for i := applied - 1; i >= 0; i-- {
+		if len(undo[i].Op) == 0 {
+			continue
+		}
+		if err := core.ApplyChanges(store, undo[i:i+1]); err != nil {
+			slog.Error("error rolling back change", "op", undo[i].Op, "property", undo[i].Property, "key", undo[i].Key, "error", err)
+		}
+	}
+}
+
+// applySourceChanges records changes reported by source and applies the effective changes
+// with reconcile the changes are the complete set of associations reported by source
+// when applying fails the recorded changes are reverted, so source retrying them is applied again
+func (s *CoreStores) applySourceChanges(source string, changes []core.Change, reconcile bool) error {
+	if err := core.ValidateChanges(changes); err != nil {
+		return err
+	}
+
+	s.sourcesLock.Lock()
+	defer s.sourcesLock.Unlock()
+
+	var effective []core.Change
+	var undo func()
+	if reconcile {
+		effective, undo = s.sources.ReconcileWithUndo(source, changes)
+	} else {
+		effective, undo = s.sources.ApplyWithUndo(source, changes)
+	}
+
+	if err := s.applyChanges(effective); err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// createStore creates backup store of registered backend specified in configuration
+// backend specific settings are decoded from BackupOptions
+func createStore(cfg Store) (core.Store, error) {
+	decode := func(opts interface{}) error {
+		jsOptions, err := json.Marshal(cfg.BackupOptions)
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(jsOptions))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(opts); err != nil {
+			return fmt.Errorf("invalid BackupOptions for %s backend of store %s: %v", cfg.Backup, cfg.Name, err)
+		}
+		return nil
+	}
+	return core.CreateBackend(cfg.Backup, cfg.Backupdir, decode)
+}
+
+// durableMeta returns store persisting meta across restarts,
+// backup store if configured otherwise primary store with write ahead log
+func (s *CoreStores) durableMeta() (core.MetaStore, bool) {
+	if s.writeBehind != nil {
+		return s.writeBehind, true
+	}
+	if s.backup != nil {
+		metaStore, ok := s.backup.(core.MetaStore)
+		return metaStore, ok
+	}
+	if primary, ok := s.primary.(*core.InMemoryStore); ok && primary.Durable() {
+		return primary, true
+	}
+	if primary, ok := s.primary.(*core.TieredStore); ok {
+		return primary, true
+	}
+	return nil, false
+}
+
+// createPrimaryStore in memory, durable with write ahead log if configured
+// or sharded for write heavy workloads when shards are configured
+// or tiered over the backup store when primary cache is configured
+func createPrimaryStore(cfg Store) (core.Store, error) {
+	if cfg.PrimaryCacheMB > 0 {
+		if len(cfg.Backup) == 0 {
+			return nil, fmt.Errorf("store %s: PrimaryCache requires a Backup store", cfg.Name)
+		}
+		if cfg.Shards > 0 || len(cfg.WALDir) > 0 || cfg.BackupWriteBehind {
+			return nil, fmt.Errorf("store %s: Shards, WAL and BackupWriteBehind are not supported with tiered primary store", cfg.Name)
+		}
+		backing, err := createStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		store := new(core.TieredStore)
+		return store, core.InitializeStore(store, &core.TieredStoreConfig{Backing: backing, BudgetBytes: int64(cfg.PrimaryCacheMB) << 20})
+	}
+
+	if cfg.Shards > 0 {
+		if len(cfg.WALDir) > 0 {
+			return nil, fmt.Errorf("store %s: WAL is not supported with sharded primary store", cfg.Name)
+		}
+		store := new(core.ShardedInMemoryStore)
+		return store, core.InitializeStore(store, &core.ShardedInMemoryStoreConfig{Shards: cfg.Shards})
+	}
+
 	store := new(core.InMemoryStore)
-	return store, core.InitializeStore(store, nil)
+	if len(cfg.WALDir) == 0 {
+		return store, core.InitializeStore(store, nil)
+	}
+
+	opts := &core.InMemoryStoreConfig{
+		WALDir:           cfg.WALDir,
+		WALSync:          cfg.WALSync,
+		SyncInterval:     time.Duration(cfg.WALSyncIntervalSec) * time.Second,
+		CompactThreshold: cfg.WALCompactThreshold,
+		CompactInterval:  time.Duration(cfg.WALCompactIntervalSec) * time.Second,
+	}
+	return store, core.InitializeStore(store, opts)
 }
 
 // InitializeStores initializes all the predefined store in configuration
 func (ctx *Context) InitializeStores() error {
 	var err error
 	ctx.stores = make(map[string]*CoreStores)
+	ctx.pendingStores = make(map[string]Store)
 	for _, store := range ctx.config.Stores {
-		// Initialize primary in memory store
-		log.Printf("Initializing Primary InMemoryStore %s\n", store.Name)
-		newstore := &CoreStores{}
-		var localerr error
-		if newstore.primary, localerr = createStore("InMemory", ""); localerr != nil {
+		newstore, localerr := ctx.openStore(store)
+		if localerr != nil {
 			err = localerr
 		}
-		// Initialize backup store if defined
-		if len(store.Backup) > 0 {
-			log.Printf("Initializing Backup Store %s of type %s, backup directory %s\n", store.Name, store.Backup, store.Backupdir)
-			var localerr error
-			if newstore.backup, localerr = createStore(store.Backup, store.Backupdir); localerr != nil {
-				err = localerr
+		ctx.stores[store.Name] = newstore
+	}
+	return err
+}
+
+// openStore initializes primary and backup store restoring their contents,
+// starting sync, replication and snapshots as configured
+// store is returned along with the last error, so it could be shutdown
+func (ctx *Context) openStore(store Store) (*CoreStores, error) {
+	var err error
+	// Initialize primary in memory store
+	slog.Info("initializing primary store", "store", store.Name)
+	newstore := &CoreStores{config: store, changes: core.NewChangeLog(store.ChangeLogSize), sources: core.NewSourceIndex()}
+	var localerr error
+	if newstore.primary, localerr = createPrimaryStore(store); localerr != nil {
+		err = localerr
+	}
+	// Initialize backup store if defined, tiered primary store already reads and writes it
+	if len(store.Backup) > 0 && store.PrimaryCacheMB == 0 {
+		slog.Info("initializing backup store", "store", store.Name, "backend", store.Backup, "dir", store.Backupdir)
+		var localerr error
+		if newstore.backup, localerr = createStore(store); localerr != nil {
+			err = localerr
+		} else {
+			// Once initialized we need to restore the primary store from backup store
+			jsStore, serr := core.SerializeStore(newstore.backup)
+			if serr != nil {
+				err = serr
 			} else {
-				// Once initialized we need to restore the primary store from backup store
-				jsStore, serr := core.SerializeStore(newstore.backup)
-				if serr != nil {
-					err = serr
-				} else {
-					if dserr := core.DeSerializeStore(newstore.primary, jsStore); dserr != nil {
-						err = dserr
-					}
+				if dserr := core.DeSerializeStore(newstore.primary, jsStore); dserr != nil {
+					err = dserr
 				}
 			}
 		}
-		if len(store.AggregateURLs) > 0 {
-			newstore.shutdown = make(chan bool)
-			go ctx.SyncAggregateURLs(newstore, store.AggregateURLs, time.Duration(store.SyncIntervalSec)*time.Second)
+	}
+	if newstore.backup != nil && store.BackupWriteBehind {
+		newstore.writeBehind = newWriteBehind(newstore.backup, store)
+		newstore.writeBehind.start()
+	}
+	newstore.snapshotter = newSnapshotter(newstore, store)
+	if len(store.Backup) == 0 && len(store.WALDir) == 0 && store.SnapshotIntervalMin > 0 && localerr == nil {
+		// without other durable copy restore the newest valid snapshot of configured snapshots
+		name, changes, serr := newstore.snapshotter.latest()
+		if serr != nil {
+			err = serr
+		} else if len(name) > 0 {
+			slog.Info("restoring store from snapshot", "store", store.Name, "snapshot", name)
+			if aerr := core.ApplyChanges(newstore.primary, changes); aerr != nil {
+				err = aerr
+			}
 		}
-		ctx.stores[store.Name] = newstore
 	}
-	return err
+	newstore.snapshotter.start()
+	ctx.startSync(newstore, store)
+	ctx.startReplication(newstore, store)
+	return newstore, err
+}
+
+// startSync of aggregate urls of store
+func (ctx *Context) startSync(newstore *CoreStores, store Store) {
+	if len(store.AggregateURLs) > 0 {
+		newstore.shutdown = make(chan bool)
+		newstore.syncer = newAggregateSync(newstore, store, ctx.syncTransport)
+		go ctx.SyncAggregateURLs(newstore)
+	}
+}
+
+// startReplication to replicate urls of store
+func (ctx *Context) startReplication(newstore *CoreStores, store Store) {
+	if len(store.ReplicateURLs) > 0 {
+		newstore.replicator = newReplicator(newstore, store, store.ReplicateSource, ctx.syncTransport)
+		newstore.replicator.start()
+	}
+}
+
+// stopSync waiting for pending requests to finish
+func stopSync(store *CoreStores) {
+	if store.shutdown != nil {
+		store.shutdown <- true
+		// wait for sync to finish pending requests
+		<-store.shutdown
+	}
+}
+
+// reconfigureStore restarts aggregate sync and replication of store with settings of cfg
+// replication restarts by pushing the complete store, so downstream stores miss no changes
+func (ctx *Context) reconfigureStore(store *CoreStores, cfg Store) {
+	// sync applies changes to the store, so it is stopped before writes are blocked
+	stopSync(store)
+
+	store.writeLock.Lock()
+	defer store.writeLock.Unlock()
+	if store.replicator != nil {
+		store.replicator.stop()
+	}
+
+	store.reloadLock.Lock()
+	defer store.reloadLock.Unlock()
+	store.config = cfg
+	store.shutdown, store.syncer, store.replicator = nil, nil, nil
+	ctx.startSync(store, cfg)
+	ctx.startReplication(store, cfg)
+}
+
+// settings store is running with
+func (s *CoreStores) settings() Store {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.config
+}
+
+// aggregateSyncer of store, nil without aggregate urls
+func (s *CoreStores) aggregateSyncer() *aggregateSync {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.syncer
 }
 
 // ShutdownStores shutsdown all the predefined store in configuration
 func (ctx *Context) ShutdownStores() error {
+	ctx.storesLock.Lock()
+	defer ctx.storesLock.Unlock()
+
 	var err error
 	for _, store := range ctx.stores {
-		if store.shutdown != nil {
-			store.shutdown <- true
-		}
-
-		// shutdown primary store
-		if localerr := core.ShutdownStore(store.primary); localerr != nil {
+		if localerr := closeStore(store); localerr != nil {
 			err = localerr
 		}
-		// shutdown backup stores if any
-		if store.backup != nil {
-			if localerr := core.ShutdownStore(store.backup); localerr != nil {
-				err = localerr
-			}
-		}
 	}
 	return err
 }
 
-// SyncAggregateURLs performs sync of key values from remote stores
-// Requires Extensive error checking, metrics, alerting
-func (ctx *Context) SyncAggregateURLs(store *CoreStores, aggregateURLs []string, syncIntervalsecs time.Duration) {
-	defer close(store.shutdown)
-	ticker := time.NewTicker(syncIntervalsecs)
-	for {
-		select {
-		case <-ticker.C:
-			for _, aggregateURL := range aggregateURLs {
-				backupURL := aggregateURL + "/backup"
-				httpResp, httpErr := http.Get(backupURL)
-
-				if httpErr != nil {
-					continue
-				}
+// closeStore stops sync, replication and snapshots, flushing and shutting down primary and backup store
+func closeStore(store *CoreStores) error {
+	var err error
+	stopSync(store)
+
+	if store.replicator != nil {
+		store.replicator.stop()
+	}
 
-				bodyBytes, rerr := ioutil.ReadAll(httpResp.Body)
-				httpResp.Body.Close()
+	store.snapshotter.stop()
 
-				if rerr != nil {
-					continue
-				}
-				if store.backup != nil {
-					if err := core.DeSerializeStore(store.backup, bodyBytes); err != nil {
-						// Error deserializing the backup store
-					}
-				}
-				if err := core.DeSerializeStore(store.primary, bodyBytes); err != nil {
-					// Error deserializing the primary store
-				}
-			}
-		case <-store.shutdown:
-			ticker.Stop()
-			return
+	// flush changes queued for backup before closing it
+	if store.writeBehind != nil {
+		store.writeBehind.stop()
+	}
+
+	// shutdown primary store, missing if it failed to initialize
+	if store.primary != nil {
+		if localerr := core.ShutdownStore(store.primary); localerr != nil {
+			err = localerr
 		}
 	}
+	// shutdown backup stores if any
+	if store.backup != nil {
+		if localerr := core.ShutdownStore(store.backup); localerr != nil {
+			err = localerr
+		}
+	}
+	return err
+}
 
+// store returns store name, safe for use while stores are created or dropped
+func (ctx *Context) store(name string) (*CoreStores, bool) {
+	ctx.storesLock.RLock()
+	defer ctx.storesLock.RUnlock()
+	store, ok := ctx.stores[name]
+	return store, ok
 }
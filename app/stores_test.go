@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+	"github.com/julienschmidt/httprouter"
+)
+
+// failingStore fails every write of failKey
+type failingStore struct {
+	core.InMemoryStore
+	failKey string
+}
+
+func (s *failingStore) Update(key, value string) error {
+	if value == s.failKey {
+		return fmt.Errorf("backup unavailable")
+	}
+	return s.InMemoryStore.Update(key, value)
+}
+
+func (s *failingStore) Remove(key, value string) error {
+	if value == s.failKey {
+		return fmt.Errorf("backup unavailable")
+	}
+	return s.InMemoryStore.Remove(key, value)
+}
+
+func TestApplyChangesBackupFailure(t *testing.T) {
+	primary := &core.InMemoryStore{}
+	core.InitializeStore(primary, nil)
+	backup := &failingStore{failKey: "m3"}
+	core.InitializeStore(backup, nil)
+
+	store := &CoreStores{primary: primary, backup: backup, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+	ctx := &Context{stores: map[string]*CoreStores{"local": store}}
+
+	if err := store.applyChanges([]core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: "m1"}}); err != nil {
+		t.Error(err)
+		return
+	}
+	cursor := store.changes.Cursor()
+
+	// backup fails writing m3, so none of the changes should remain
+	req := httptest.NewRequest("POST", "/v1/store/local/update", bytes.NewBufferString(`{"m2": {"num": "6.13"}, "m3": {"num": "6.13"}}`))
+	w := httptest.NewRecorder()
+	ctx.updateStore(w, req, httprouter.Params{{Key: "store", Value: "local"}})
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected backup failure to be reported with 500, found %d: %s", w.Code, w.Body.String())
+	}
+
+	for name, s := range map[string]core.Store{"primary": primary, "backup": &backup.InMemoryStore} {
+		keys, err := s.Query("num:6.13")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		sort.Strings(keys)
+		if len(keys) != 1 || keys[0] != "m1" {
+			t.Errorf("Expected %s store rolled back to [m1], found %v", name, keys)
+		}
+	}
+
+	if store.changes.Cursor() != cursor {
+		t.Errorf("Expected failed changes not to be recorded in change log")
+	}
+
+	// failed removal keeps the association in both stores
+	backup.failKey = "m1"
+	if err := store.applyChanges([]core.Change{{Op: core.ChangeRemove, Property: "num:6.13", Key: "m1"}}); err == nil {
+		t.Errorf("Expected removal to fail")
+	}
+	if keys, err := primary.Query("num:6.13"); err != nil || len(keys) != 1 {
+		t.Errorf("Expected primary to keep m1 after failed removal, found %v, %v", keys, err)
+	}
+}
+
+// failingBackend fails every write of failKey to the wrapped store
+type failingBackend struct {
+	core.Store
+	failKey string
+}
+
+func (s *failingBackend) Update(key, value string) error {
+	if value == s.failKey {
+		return fmt.Errorf("backup unavailable")
+	}
+	return s.Store.Update(key, value)
+}
+
+func TestApplyChangesBoltBackupRollback(t *testing.T) {
+	os.RemoveAll("./rollbacktest")
+	defer os.RemoveAll("./rollbacktest")
+
+	bolt, err := createStore(Store{Name: "local", Backup: "BoltDB", Backupdir: "./rollbacktest"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bolt.Shutdown()
+	primary := &core.InMemoryStore{}
+	core.InitializeStore(primary, nil)
+	backup := &failingBackend{Store: bolt, failKey: "m3"}
+
+	store := &CoreStores{primary: primary, backup: backup, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+
+	// bolt keeps the case of properties, rollback has to remove them as they were written
+	changes := []core.Change{{Op: core.ChangeAdd, Property: "Num:6.13", Key: "M2"}, {Op: core.ChangeAdd, Property: "Num:6.13", Key: "m3"}}
+	if err := store.applyChanges(changes); err == nil {
+		t.Errorf("Expected backup failure")
+	}
+
+	for name, s := range map[string]core.Store{"primary": primary, "backup": bolt} {
+		if keys, err := s.Query("Num:6.13"); err == nil && len(keys) > 0 {
+			t.Errorf("Expected %s store rolled back, found %v", name, keys)
+		}
+	}
+}
+
+func TestApplyChangesTieredPrimaryRollback(t *testing.T) {
+	os.RemoveAll("./tieredrollbacktest")
+	defer os.RemoveAll("./tieredrollbacktest")
+
+	bolt, err := createStore(Store{Name: "local", Backup: "BoltDB", Backupdir: "./tieredrollbacktest"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	primary := &core.TieredStore{}
+	if err := core.InitializeStore(primary, &core.TieredStoreConfig{Backing: &failingBackend{Store: bolt, failKey: "m3"}, BudgetBytes: 1 << 20}); err != nil {
+		t.Error(err)
+		return
+	}
+	defer primary.Shutdown()
+
+	store := &CoreStores{primary: primary, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+
+	// changes written through before the failure are reverted in the backing store
+	changes := []core.Change{{Op: core.ChangeAdd, Property: "Num:6.13", Key: "M2"}, {Op: core.ChangeAdd, Property: "Num:6.13", Key: "m3"}}
+	if err := store.applyChanges(changes); err == nil {
+		t.Errorf("Expected primary failure")
+	}
+
+	for name, s := range map[string]core.Store{"primary": primary, "backing": bolt} {
+		if keys, err := s.Query("Num:6.13"); err == nil && len(keys) > 0 {
+			t.Errorf("Expected %s store rolled back, found %v", name, keys)
+		}
+	}
+}
+
+func TestApplySourceChangesFailure(t *testing.T) {
+	primary := &core.InMemoryStore{}
+	core.InitializeStore(primary, nil)
+	backup := &failingStore{}
+	core.InitializeStore(backup, nil)
+
+	store := &CoreStores{primary: primary, backup: backup, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+
+	add := []core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: "m1"}}
+	if err := store.applySourceChanges("regionA", add, false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	backup.failKey = "m1"
+	remove := []core.Change{{Op: core.ChangeRemove, Property: "num:6.13", Key: "m1"}}
+	if err := store.applySourceChanges("regionA", remove, false); err == nil {
+		t.Errorf("Expected removal to fail")
+	}
+
+	// retried removal is applied once backup recovers
+	backup.failKey = ""
+	if err := store.applySourceChanges("regionA", remove, false); err != nil {
+		t.Error(err)
+		return
+	}
+	if keys, err := primary.Query("num:6.13"); err == nil {
+		t.Errorf("Expected retried removal to be applied, found %v", keys)
+	}
+}
+
+func TestApplyChangesConcurrentProperties(t *testing.T) {
+	primary := &core.ShardedInMemoryStore{}
+	core.InitializeStore(primary, nil)
+	store := &CoreStores{primary: primary, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+
+	blocked := []core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: "m1"}}
+	other := "strs:a"
+	for writeStripe(other) == writeStripe(blocked[0].Property) {
+		other += "a"
+	}
+
+	// writes of a property wait for writes of the same property, not for other properties
+	unlock := store.writeLock.lockProperties(blocked)
+	done := make(chan error, 2)
+	go func() { done <- store.applyChanges(blocked) }()
+	go func() { done <- store.applyChanges([]core.Change{{Op: core.ChangeAdd, Property: other, Key: "m2"}}) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected write of other property not blocked")
+	}
+	if keys, err := primary.Query("num:6.13"); err == nil {
+		t.Errorf("Expected write of locked property blocked, found %v", keys)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// benchmarkParallelApplyChanges reporters updating separate properties through the write path of the server
+func benchmarkParallelApplyChanges(primary core.Store, b *testing.B) {
+	core.InitializeStore(primary, nil)
+	defer core.ShutdownStore(primary)
+	store := &CoreStores{primary: primary, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+
+	var reporter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt64(&reporter, 1)
+		n := 0
+		for pb.Next() {
+			change := core.Change{Op: core.ChangeAdd, Property: fmt.Sprintf("num:%d", n%1000), Key: fmt.Sprintf("m%d", id)}
+			if err := store.applyChanges([]core.Change{change}); err != nil {
+				b.Error(err)
+				return
+			}
+			n++
+		}
+	})
+}
+
+func BenchmarkInMemCoreStoresParallelApply(b *testing.B) {
+	benchmarkParallelApplyChanges(&core.InMemoryStore{}, b)
+}
+
+func BenchmarkShardedCoreStoresParallelApply(b *testing.B) {
+	benchmarkParallelApplyChanges(&core.ShardedInMemoryStore{}, b)
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// TLSConfig certificate and key served by the listener
+// client certificates are required and verified against ClientCAFile when set
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// ClientTLSConfig CA bundle verifying remote stores and client certificate presented to them
+// by aggregate sync and replication, system roots are used when CAFile is not set
+type ClientTLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// enabled when certificate and key are configured
+func (cfg *TLSConfig) enabled() bool {
+	return len(cfg.CertFile) > 0
+}
+
+// validate certificate and key are configured together, client CA only along with them
+func (cfg *TLSConfig) validate() error {
+	if len(cfg.CertFile) > 0 != (len(cfg.KeyFile) > 0) {
+		return fmt.Errorf("TLS requires both CertFile and KeyFile")
+	}
+	if len(cfg.ClientCAFile) > 0 && !cfg.enabled() {
+		return fmt.Errorf("TLS ClientCAFile requires CertFile and KeyFile")
+	}
+	return nil
+}
+
+// serverConfig loads certificate and client CA of the listener
+func (cfg *TLSConfig) serverConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(cfg.ClientCAFile) > 0 {
+		if tlsConfig.ClientCAs, err = loadCertPool(cfg.ClientCAFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// validate certificate and key are configured together
+func (cfg *ClientTLSConfig) validate() error {
+	if len(cfg.CertFile) > 0 != (len(cfg.KeyFile) > 0) {
+		return fmt.Errorf("SyncTLS requires both CertFile and KeyFile")
+	}
+	return nil
+}
+
+// transport of requests to remote stores, nil uses default transport when nothing is configured
+func (cfg *ClientTLSConfig) transport() (http.RoundTripper, error) {
+	if len(cfg.CAFile) == 0 && len(cfg.CertFile) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if len(cfg.CAFile) > 0 {
+		if tlsConfig.RootCAs, err = loadCertPool(cfg.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// loadCertPool of PEM encoded certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert signs certificate of name with parent, self signed when parent is nil
+// writes name.pem and name-key.pem to dir
+func writeTestCert(dir, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func TestMutualTLS(t *testing.T) {
+	const certDir string = "./tlstest"
+	os.RemoveAll(certDir)
+	defer os.RemoveAll(certDir)
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ca, caKey, err := writeTestCert(certDir, "ca", true, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, name := range []string{"server", "client"} {
+		if _, _, err := writeTestCert(certDir, name, false, ca, caKey); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	buf := []byte(`
+Port : 8080
+AdminListen : 127.0.0.1:8081
+TLS :
+  CertFile : ./tlstest/server.pem
+  KeyFile : ./tlstest/server-key.pem
+  ClientCAFile : ./tlstest/ca.pem
+SyncTLS :
+  CAFile : ./tlstest/ca.pem
+  CertFile : ./tlstest/client.pem
+  KeyFile : ./tlstest/client-key.pem
+Stores :
+- local:
+- aggregate:
+    SyncInterval : 1
+    Aggregate:
+      - https://127.0.0.1:8080/v1/store/local
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// plain http and clients without certificate are refused
+	if resp, err := http.Get("http://127.0.0.1:8080/v1/health"); err == nil && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		t.Errorf("Expected plain http refused")
+	}
+	noCertClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := noCertClient.Get("https://127.0.0.1:8080/v1/health"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected client without certificate refused")
+	}
+
+	client := &http.Client{Transport: ctx.syncTransport}
+
+	// admin listener serves https with the same settings
+	if resp, err := http.Get("http://127.0.0.1:8081/v1/health"); err == nil && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		t.Errorf("Expected plain http refused by admin listener")
+	}
+	if resp, err := client.Get("https://127.0.0.1:8081/v1/health"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected admin health over https, found %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+	resp, err := client.Post("https://127.0.0.1:8080/v1/store/local/update", "application/json", strings.NewReader(`{"m1": {"num": "6.13"}}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected update with client certificate, found %v, %v", resp, err)
+		return
+	}
+	resp.Body.Close()
+
+	// aggregate store syncs over https presenting client certificate
+	time.Sleep(2 * time.Second)
+	resp, err = client.Post("https://127.0.0.1:8080/v1/store/aggregate/query", "application/json", strings.NewReader(`{"num": "6.13"}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `["m1"]` {
+		t.Errorf("Expected aggregate store synced over mutual tls, found %d %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestInvalidTLSConfig(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+TLS :
+  CertFile : ./missing.pem
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if ctx, err := CreateContext("config", "./config"); err == nil {
+		DeleteContext(ctx)
+		t.Errorf("Expected certificate without key to fail")
+	}
+}
@@ -0,0 +1,439 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/awesomenix/keypropstore/core"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// configErrors every problem found in configuration, each prefixed by path of the setting
+type configErrors []string
+
+func (errs configErrors) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(errs, "\n\t")
+}
+
+// configDecoder decodes yaml values into typed settings of cfg
+// collecting every problem rather than stopping at the first one
+type configDecoder struct {
+	cfg    *Config
+	errors configErrors
+	// path of each configured store, reported along with problems of the store
+	storePaths map[string]string
+}
+
+func newConfigDecoder(cfg *Config) *configDecoder {
+	return &configDecoder{cfg: cfg, storePaths: make(map[string]string)}
+}
+
+func (d *configDecoder) errorf(path, format string, args ...interface{}) {
+	d.errors = append(d.errors, path+": "+fmt.Sprintf(format, args...))
+}
+
+// err of decoding, nil when no problem was found
+func (d *configDecoder) err() error {
+	if len(d.errors) == 0 {
+		return nil
+	}
+	return d.errors
+}
+
+// joinPath of setting key below path
+func joinPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// describe yaml value found in place of expected one
+func describe(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nothing"
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case int:
+		return fmt.Sprintf("integer %d", v)
+	case float64:
+		return fmt.Sprintf("number %v", v)
+	case bool:
+		return fmt.Sprintf("boolean %v", v)
+	case []interface{}:
+		return "list"
+	case map[interface{}]interface{}, map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// settings map at path, nested maps read by viper have either yaml or string keys
+func (d *configDecoder) settings(path string, value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		settings := make(map[string]interface{})
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				d.errorf(joinPath(path, fmt.Sprint(key)), "expected name, found %s", describe(key))
+				continue
+			}
+			settings[name] = item
+		}
+		return settings, true
+	}
+	d.errorf(path, "expected map, found %s", describe(value))
+	return nil, false
+}
+
+// sortedSettings keys of settings, so problems are reported in the same order every time
+func sortedSettings(settings map[string]interface{}) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fields decodes settings at path into targets by key, matched case insensitively like top level keys
+// and reported by the known key, unknown keys are reported
+func (d *configDecoder) fields(path string, value interface{}, targets map[string]interface{}) {
+	settings, ok := d.settings(path, value)
+	if !ok {
+		return
+	}
+	for _, key := range sortedSettings(settings) {
+		name, ok := key, false
+		for known := range targets {
+			if strings.EqualFold(known, key) {
+				name, ok = known, true
+			}
+		}
+		if !ok {
+			d.errorf(joinPath(path, key), "unknown setting")
+			continue
+		}
+		d.decode(joinPath(path, name), settings[key], targets[name])
+	}
+}
+
+// decode value at path into target, integers are never negative
+func (d *configDecoder) decode(path string, value interface{}, target interface{}) {
+	switch t := target.(type) {
+	case *string:
+		if s, ok := value.(string); ok {
+			*t = s
+		} else {
+			d.errorf(path, "expected string, found %s", describe(value))
+		}
+	case *int:
+		if i, ok := value.(int); !ok {
+			d.errorf(path, "expected integer, found %s", describe(value))
+		} else if i < 0 {
+			d.errorf(path, "expected integer of at least 0, found %d", i)
+		} else {
+			*t = i
+		}
+	case *float64:
+		switch v := value.(type) {
+		case int:
+			*t = float64(v)
+		case float64:
+			*t = v
+		default:
+			d.errorf(path, "expected number, found %s", describe(value))
+		}
+	case *bool:
+		if b, ok := value.(bool); ok {
+			*t = b
+		} else {
+			d.errorf(path, "expected true or false, found %s", describe(value))
+		}
+	case *[]string:
+		list, ok := value.([]interface{})
+		if !ok {
+			d.errorf(path, "expected list, found %s", describe(value))
+			return
+		}
+		*t = make([]string, 0, len(list))
+		for i, item := range list {
+			var s string
+			d.decode(fmt.Sprintf("%s[%d]", path, i), item, &s)
+			*t = append(*t, s)
+		}
+	case *map[string]interface{}:
+		if settings, ok := d.settings(path, value); ok {
+			*t = stringKeys(settings).(map[string]interface{})
+		}
+	case *TLSConfig:
+		d.fields(path, value, map[string]interface{}{"CertFile": &t.CertFile, "KeyFile": &t.KeyFile, "ClientCAFile": &t.ClientCAFile})
+	case *ClientTLSConfig:
+		d.fields(path, value, map[string]interface{}{"CAFile": &t.CAFile, "CertFile": &t.CertFile, "KeyFile": &t.KeyFile})
+	case *map[string]RateLimit:
+		d.rateLimits(path, value, *t)
+	case *[]Credential:
+		d.credentials(path, value, t)
+	case *[]Store:
+		d.stores(path, value, t)
+	default:
+		d.errorf(path, "unsupported setting of type %T", target)
+	}
+}
+
+// rateLimits by route class at path
+func (d *configDecoder) rateLimits(path string, value interface{}, limits map[string]RateLimit) {
+	settings, ok := d.settings(path, value)
+	if !ok {
+		return
+	}
+	for _, class := range sortedSettings(settings) {
+		classPath := joinPath(path, class)
+		if !validScope(class) {
+			d.errorf(classPath, "unknown rate limit class, available classes %v", scopes)
+			continue
+		}
+		var limit RateLimit
+		d.fields(classPath, settings[class], map[string]interface{}{"Rate": &limit.Rate, "Burst": &limit.Burst})
+		if limit.Rate <= 0 {
+			d.errorf(joinPath(classPath, "Rate"), "expected number greater than 0, found %v", limit.Rate)
+		}
+		limits[class] = limit
+	}
+}
+
+// credentials at path, each with name, token and known scopes per store
+func (d *configDecoder) credentials(path string, value interface{}, credentials *[]Credential) {
+	list, ok := value.([]interface{})
+	if !ok {
+		d.errorf(path, "expected list of credentials, found %s", describe(value))
+		return
+	}
+	for i, item := range list {
+		credentialPath := fmt.Sprintf("%s[%d]", path, i)
+		credential := Credential{Scopes: make(map[string][]string)}
+		var storeScopes map[string]interface{}
+		d.fields(credentialPath, item, map[string]interface{}{"Name": &credential.Name, "Token": &credential.Token, "Scopes": &storeScopes})
+		if len(credential.Name) == 0 || len(credential.Token) == 0 {
+			d.errorf(credentialPath, "credential requires Name and Token")
+		}
+		for _, storeName := range sortedSettings(storeScopes) {
+			scopesPath := joinPath(credentialPath, "Scopes."+storeName)
+			var granted []string
+			d.decode(scopesPath, storeScopes[storeName], &granted)
+			for j, scope := range granted {
+				if !validScope(scope) {
+					d.errorf(fmt.Sprintf("%s[%d]", scopesPath, j), "unknown scope %s, available scopes %v", scope, scopes)
+				}
+			}
+			credential.Scopes[storeName] = granted
+		}
+		*credentials = append(*credentials, credential)
+	}
+}
+
+// stores at path, a list of maps of store name to its settings
+func (d *configDecoder) stores(path string, value interface{}, stores *[]Store) {
+	list, ok := value.([]interface{})
+	if !ok {
+		d.errorf(path, "expected list of stores, found %s", describe(value))
+		return
+	}
+	*stores = make([]Store, 0, len(list))
+	for i, item := range list {
+		named, ok := d.settings(fmt.Sprintf("%s[%d]", path, i), item)
+		if !ok {
+			continue
+		}
+		for _, name := range sortedSettings(named) {
+			storePath := fmt.Sprintf("%s[%d].%s", path, i, name)
+			store := d.cfg.defaultStore(name)
+			if named[name] != nil {
+				d.fields(storePath, named[name], store.fields())
+			}
+
+			if !validStoreName(name) {
+				d.errorf(storePath, "invalid store name, expected letters, digits, '-', '_' or '.'")
+			}
+			if previous, ok := d.storePaths[name]; ok {
+				d.errorf(storePath, "duplicate store name, already configured at %s", previous)
+			} else {
+				d.storePaths[name] = storePath
+			}
+			d.validateStore(storePath, store)
+			*stores = append(*stores, store)
+		}
+	}
+}
+
+// validateStore settings decoded at path
+func (d *configDecoder) validateStore(path string, store Store) {
+	if len(store.Backup) > 0 && !core.IsBackend(store.Backup) {
+		d.errorf(joinPath(path, "Backup"), "unknown backend %s, available backends %v", store.Backup, core.Backends())
+	} else if len(store.Backup) > 0 && !core.IsDurableBackend(store.Backup) {
+		d.errorf(joinPath(path, "Backup"), "backend %s keeps the store only in memory, expected durable backend", store.Backup)
+	}
+	if len(store.Backup) > 0 && len(store.Backupdir) == 0 {
+		d.errorf(joinPath(path, "BackupDir"), "required with Backup")
+	}
+	// defaults are greater than 0, so 0 is configured explicitly
+	if store.SyncIntervalSec == 0 {
+		d.errorf(joinPath(path, "SyncInterval"), "expected integer greater than 0")
+	}
+	if store.SyncTimeoutSec == 0 {
+		d.errorf(joinPath(path, "SyncTimeout"), "expected integer greater than 0")
+	}
+	if store.SyncMaxBackoffSec == 0 {
+		d.errorf(joinPath(path, "SyncMaxBackoff"), "expected integer greater than 0")
+	}
+	switch store.WALSync {
+	case core.WALSyncAlways, core.WALSyncNone:
+	case core.WALSyncInterval:
+		if store.WALSyncIntervalSec == 0 {
+			d.errorf(joinPath(path, "WALSyncInterval"), "expected integer greater than 0")
+		}
+	default:
+		d.errorf(joinPath(path, "WALSync"), "unknown sync mode %s, expected %s, %s or %s", store.WALSync, core.WALSyncAlways, core.WALSyncInterval, core.WALSyncNone)
+	}
+	for i, storeURL := range store.AggregateURLs {
+		d.validateURL(fmt.Sprintf("%s.Aggregate[%d]", path, i), storeURL)
+	}
+	for i, storeURL := range store.ReplicateURLs {
+		d.validateURL(fmt.Sprintf("%s.Replicate[%d]", path, i), storeURL)
+	}
+	if len(store.ReplicateSource) > 0 {
+		d.validateURL(joinPath(path, "ReplicateSource"), store.ReplicateSource)
+	} else if len(store.ReplicateURLs) > 0 {
+		// downstream stores track associations by source, which must be unique across every replicating store
+		d.errorf(joinPath(path, "ReplicateSource"), "required with Replicate, expected url of this store unique to downstream stores")
+	}
+}
+
+// validateURL of a remote store, http or https with a host
+func (d *configDecoder) validateURL(path, storeURL string) {
+	parsed, err := url.Parse(storeURL)
+	if err != nil {
+		d.errorf(path, "malformed url: %v", err)
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || len(parsed.Host) == 0 {
+		d.errorf(path, "malformed url %q, expected http://host:port/v1/store/name or https://", storeURL)
+	}
+}
+
+// validateListen address at path, host:port or unix:/path/to/socket
+func (d *configDecoder) validateListen(path, address string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		if len(address) == len(unixPrefix) {
+			d.errorf(path, "expected unix:/path/to/socket, found %q", address)
+		}
+		return
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		d.errorf(path, "expected host:port or unix:/path/to/socket, %v", err)
+	}
+}
+
+// validateStoreDirs are not shared by stores, the backup directory or write ahead log of one store
+// overlapping another one would open the same files twice and be removed along with either store
+func (d *configDecoder) validateStoreDirs(stores []Store) {
+	for i, created := range stores {
+		for _, store := range stores[:i] {
+			if conflict := sharedStoreDir(store, created); len(conflict) > 0 {
+				d.errorf(d.storePath(created), "directory %s is also used by store %s", conflict, store.Name)
+			}
+		}
+	}
+}
+
+// storePath of store in configuration file, or in StoresFile when created at runtime
+func (d *configDecoder) storePath(store Store) string {
+	if path, ok := d.storePaths[store.Name]; ok && !store.Runtime {
+		return path
+	}
+	return joinPath(d.cfg.StoresFile, store.Name)
+}
+
+// port of yaml integer or numeric string
+func (d *configDecoder) port(path string, value interface{}) string {
+	var port string
+	if i, ok := value.(int); ok {
+		port = strconv.Itoa(i)
+	} else {
+		d.decode(path, value, &port)
+	}
+	if i, err := strconv.Atoi(port); err != nil || i < 0 || i > 65535 {
+		d.errorf(path, "expected port number, found %s", describe(value))
+	}
+	return port
+}
+
+// configKeys top level keys of configuration file read by v, named as written in the file
+// since viper lowercases them, so unknown keys are reported the way they were written
+func configKeys(v *viper.Viper) map[string]interface{} {
+	written := writtenKeys(v.ConfigFileUsed())
+	settings := make(map[string]interface{})
+	for _, key := range v.AllKeys() {
+		// nested keys are flattened as parent.child
+		key = strings.SplitN(key, ".", 2)[0]
+		name, ok := written[key]
+		if !ok {
+			name = key
+		}
+		settings[name] = v.Get(key)
+	}
+	return settings
+}
+
+// writtenKeys top level keys of yaml file by their lowercase name
+func writtenKeys(file string) map[string]string {
+	keys := make(map[string]string)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return keys
+	}
+	// errors are reported by viper reading the same file
+	var document yaml.MapSlice
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return keys
+	}
+	for _, item := range document {
+		if key, ok := item.Key.(string); ok {
+			keys[strings.ToLower(key)] = key
+		}
+	}
+	return keys
+}
+
+// CheckConfig validates configuration file name in dir, reporting every problem found
+// certificates are loaded as well, but stores are not opened and nothing is served
+func CheckConfig(name, dir string) error {
+	v, err := findConfig(name, dir)
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err := cfg.load(v); err != nil {
+		return err
+	}
+	if cfg.TLS.enabled() {
+		if _, err := cfg.TLS.serverConfig(); err != nil {
+			return fmt.Errorf("TLS: %v", err)
+		}
+	}
+	if _, err := cfg.SyncTLS.transport(); err != nil {
+		return fmt.Errorf("SyncTLS: %v", err)
+	}
+	fmt.Printf("configuration %s is valid, %d stores\n", v.ConfigFileUsed(), len(cfg.Stores))
+	return nil
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+	"github.com/julienschmidt/httprouter"
+)
+
+// watchHeartbeat interval between keepalive comments on idle watch streams
+const watchHeartbeat = 15 * time.Second
+
+// watchBufferSize number of committed change batches buffered for a slow watcher
+const watchBufferSize int = 64
+
+// changeSubscriber receives changes committed to a store
+// when the subscriber falls behind notifications are dropped and missed is set,
+// the subscriber should then re-evaluate from the store
+type changeSubscriber struct {
+	changes chan []core.Change
+	missed  int32
+}
+
+// takeMissed reports and clears whether notifications were dropped
+func (sub *changeSubscriber) takeMissed() bool {
+	return atomic.SwapInt32(&sub.missed, 0) == 1
+}
+
+// subscribe to changes committed to the store
+func (s *CoreStores) subscribe() *changeSubscriber {
+	sub := &changeSubscriber{changes: make(chan []core.Change, watchBufferSize)}
+
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+
+	if s.subscribers == nil {
+		s.subscribers = make(map[*changeSubscriber]struct{})
+	}
+	s.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (s *CoreStores) unsubscribe(sub *changeSubscriber) {
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+	delete(s.subscribers, sub)
+}
+
+// notify subscribers of committed changes, never blocks on slow subscribers
+func (s *CoreStores) notify(changes []core.Change) {
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+
+	for sub := range s.subscribers {
+		select {
+		case sub.changes <- changes:
+		default:
+			atomic.StoreInt32(&sub.missed, 1)
+		}
+	}
+}
+
+// watchStore streams result of a query as server sent events
+// "snapshot" event with the initial keys, followed by "added" and "removed" events
+// with keys joining or leaving the result as changes are committed to the store
+func (ctx *Context) watchStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	propQuery, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, readErrorStatus(err), err.Error())
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	properties, err := core.ParseQuery(propQuery)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(properties) == 0 {
+		respondWithError(w, http.StatusBadRequest, "watch requires at least one property")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	// subscribe before evaluating the initial result, so no change is missed in between
+	sub := store.subscribe()
+	defer store.unsubscribe(sub)
+
+	// stream outlives server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	current := watchResult(store, properties)
+	if err := writeWatchEvent(w, "snapshot", sortedKeys(current)); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ctx.watchDone:
+			return
+		case changes := <-sub.changes:
+			if sub.takeMissed() || watchRelevant(changes, properties) {
+				current, err = watchDiff(w, current, watchResult(store, properties))
+			}
+		case <-heartbeat.C:
+			if sub.takeMissed() {
+				current, err = watchDiff(w, current, watchResult(store, properties))
+			} else {
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+			}
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// watchResult evaluates query properties, missing properties result in no keys
+func watchResult(store *CoreStores, properties []string) map[string]bool {
+	result := make(map[string]bool)
+	keys, err := core.QueryProperties(store.primary, properties)
+	if err != nil {
+		return result
+	}
+	for _, key := range keys {
+		result[key] = true
+	}
+	return result
+}
+
+// watchRelevant reports whether any of the changes affect query properties
+func watchRelevant(changes []core.Change, properties []string) bool {
+	for _, change := range changes {
+		for _, property := range properties {
+			if strings.EqualFold(change.Property, property) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watchDiff writes added and removed events between current and next results
+func watchDiff(w http.ResponseWriter, current, next map[string]bool) (map[string]bool, error) {
+	added := make([]string, 0)
+	for key := range next {
+		if !current[key] {
+			added = append(added, key)
+		}
+	}
+
+	removed := make([]string, 0)
+	for key := range current {
+		if !next[key] {
+			removed = append(removed, key)
+		}
+	}
+
+	if len(added) > 0 {
+		sort.Strings(added)
+		if err := writeWatchEvent(w, "added", added); err != nil {
+			return current, err
+		}
+	}
+
+	if len(removed) > 0 {
+		sort.Strings(removed)
+		if err := writeWatchEvent(w, "removed", removed); err != nil {
+			return current, err
+		}
+	}
+
+	return next, nil
+}
+
+func writeWatchEvent(w http.ResponseWriter, event string, keys []string) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
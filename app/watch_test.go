@@ -0,0 +1,164 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type watchEvent struct {
+	event string
+	data  string
+}
+
+func readWatchEvents(resp *http.Response, events chan<- watchEvent) {
+	defer close(events)
+	scanner := bufio.NewScanner(resp.Body)
+	var event watchEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		case len(line) == 0 && len(event.event) > 0:
+			events <- event
+			event = watchEvent{}
+		}
+	}
+}
+
+func expectWatchEvent(t *testing.T, events <-chan watchEvent, event, data string) bool {
+	select {
+	case res, ok := <-events:
+		if !ok {
+			t.Errorf("Watch stream closed, expected %s %s", event, data)
+			return false
+		}
+		t.Log("Watch returned", res.event, res.data, "Expect", event, data)
+		if res.event != event || res.data != data {
+			t.Errorf("Expected %s %s, found %s %s", event, data, res.event, res.data)
+			return false
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Timed out waiting for %s %s", event, data)
+		return false
+	}
+	return true
+}
+
+func TestWatchQuery(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateDefaultContext()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// watch stream is still open when context is deleted
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	if err := postStore("http://127.0.0.1:8080/v1/store/local/update", []byte(`{"m1": {"num": "6.13", "strs": "a"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := http.Post("http://127.0.0.1:8080/v1/store/local/watch", "application/json", bytes.NewBuffer([]byte(`{"num": "6.13", "strs": "a"}`)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Watch returned %d, expected success with 200, error: %s", resp.StatusCode, resp.Status)
+		return
+	}
+
+	events := make(chan watchEvent, 10)
+	go readWatchEvents(resp, events)
+
+	if !expectWatchEvent(t, events, "snapshot", `["m1"]`) {
+		return
+	}
+
+	if err := postStore("http://127.0.0.1:8080/v1/store/local/update", []byte(`{"m2": {"num": "6.13"}, "m3": {"num": "6.13", "strs": "a"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !expectWatchEvent(t, events, "added", `["m3"]`) {
+		return
+	}
+
+	if err := postStore("http://127.0.0.1:8080/v1/store/local/remove", []byte(`{"m1": {"strs": "a"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectWatchEvent(t, events, "removed", `["m1"]`)
+}
+
+func TestWatchOutlivesWriteTimeout(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+WriteTimeout : 1
+Stores :
+- local:
+`)
+
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateDefaultContext()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	resp, err := http.Post("http://127.0.0.1:8080/v1/store/local/watch", "application/json", bytes.NewBuffer([]byte(`{"num": "6.13"}`)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	events := make(chan watchEvent, 10)
+	go readWatchEvents(resp, events)
+
+	if !expectWatchEvent(t, events, "snapshot", `[]`) {
+		return
+	}
+
+	// stream is still open after server write timeout has passed
+	time.Sleep(2 * time.Second)
+	if err := postStore("http://127.0.0.1:8080/v1/store/local/update", []byte(`{"m1": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		return
+	}
+	expectWatchEvent(t, events, "added", `["m1"]`)
+}
@@ -0,0 +1,346 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+	"github.com/julienschmidt/httprouter"
+)
+
+// writeBehindEntry committed changes or meta blob queued for the backup store
+type writeBehindEntry struct {
+	changes   []core.Change
+	metaName  string
+	metaValue []byte
+	queued    time.Time
+}
+
+// writeBehindStatus reported by backup queue endpoint
+type writeBehindStatus struct {
+	Enabled   bool   `json:"enabled"`
+	Depth     int    `json:"depth"`
+	LagMs     int64  `json:"lagMs"`
+	Applied   int64  `json:"applied"`
+	Failures  int    `json:"consecutiveFailures"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// writeBehind applies changes committed to the primary store to the backup store asynchronously
+// changes are queued in commit order and applied in batches, writers reserve room in the queue
+// and are rejected when it is full, failed batches are retried with backoff and the queue is flushed on stop
+// meta blobs are queued along with changes, so persisted cursors never get ahead of the data
+type writeBehind struct {
+	backup     core.Store
+	queueSize  int
+	batchSize  int
+	maxBackoff time.Duration
+	entries    []writeBehindEntry
+	depth      int
+	// room reserved by writers applying changes to the primary store
+	reserved  int
+	applied   int64
+	failures  int
+	lastError string
+	stopping  bool
+	lock      sync.Mutex
+	room      *sync.Cond
+	wakeup    chan struct{}
+	stopped   chan struct{}
+	running   sync.WaitGroup
+}
+
+func newWriteBehind(backup core.Store, cfg Store) *writeBehind {
+	if cfg.BackupBatchSize < 1 {
+		cfg.BackupBatchSize = 1
+	}
+	wb := &writeBehind{
+		backup:     backup,
+		queueSize:  cfg.BackupQueueSize,
+		batchSize:  cfg.BackupBatchSize,
+		maxBackoff: time.Duration(cfg.SyncMaxBackoffSec) * time.Second,
+		wakeup:     make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+	wb.room = sync.NewCond(&wb.lock)
+	return wb
+}
+
+func (wb *writeBehind) start() {
+	wb.running.Add(1)
+	go wb.run()
+}
+
+// stop flushes queued changes to backup store and stops applying
+func (wb *writeBehind) stop() {
+	wb.lock.Lock()
+	wb.stopping = true
+	wb.room.Broadcast()
+	wb.lock.Unlock()
+
+	close(wb.stopped)
+	wb.running.Wait()
+}
+
+// errBackupQueueFull rejects changes while backup store is falling behind, rather than blocking writers
+var errBackupQueueFull = fmt.Errorf("backup queue is full, backup store is falling behind")
+
+// full reports whether size more entries exceed the queue, called with lock held
+// an entry larger than the queue is accepted once the queue is empty
+func (wb *writeBehind) full(size int) bool {
+	pending := wb.depth + wb.reserved
+	return pending > 0 && pending+size > wb.queueSize
+}
+
+// reserve room for size changes, without waiting when the queue is full
+func (wb *writeBehind) reserve(size int) bool {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	if size > 0 && wb.full(size) {
+		return false
+	}
+	wb.reserved += size
+	return true
+}
+
+// cancel reservation of changes which were not committed
+func (wb *writeBehind) cancel(size int) {
+	wb.lock.Lock()
+	wb.reserved -= size
+	wb.lock.Unlock()
+}
+
+// enqueue committed changes into room reserved for them
+func (wb *writeBehind) enqueue(changes []core.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	wb.lock.Lock()
+	wb.reserved -= len(changes)
+	if wb.reserved < 0 {
+		wb.reserved = 0
+	}
+	wb.append(writeBehindEntry{changes: changes}, len(changes))
+	wb.lock.Unlock()
+	wb.notify()
+}
+
+// push entry, waiting while the queue is full
+func (wb *writeBehind) push(entry writeBehindEntry, size int) {
+	wb.lock.Lock()
+	for !wb.stopping && wb.full(size) {
+		wb.room.Wait()
+	}
+	wb.append(entry, size)
+	wb.lock.Unlock()
+	wb.notify()
+}
+
+// append entry to the queue, called with lock held
+func (wb *writeBehind) append(entry writeBehindEntry, size int) {
+	entry.queued = time.Now()
+	wb.entries = append(wb.entries, entry)
+	wb.depth += size
+}
+
+// notify run of queued entries
+func (wb *writeBehind) notify() {
+	select {
+	case wb.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// GetMeta returns queued meta blob, otherwise the one persisted in backup store
+func (wb *writeBehind) GetMeta(name string) ([]byte, error) {
+	wb.lock.Lock()
+	for i := len(wb.entries) - 1; i >= 0; i-- {
+		if wb.entries[i].changes == nil && wb.entries[i].metaName == name {
+			value := wb.entries[i].metaValue
+			wb.lock.Unlock()
+			return value, nil
+		}
+	}
+	wb.lock.Unlock()
+
+	metaStore, ok := wb.backup.(core.MetaStore)
+	if !ok {
+		return nil, fmt.Errorf("backup store does not support meta")
+	}
+	return metaStore.GetMeta(name)
+}
+
+// SetMeta queues meta blob after the changes committed so far
+func (wb *writeBehind) SetMeta(name string, value []byte) error {
+	if _, ok := wb.backup.(core.MetaStore); !ok {
+		return fmt.Errorf("backup store does not support meta")
+	}
+	wb.push(writeBehindEntry{metaName: name, metaValue: value}, 1)
+	return nil
+}
+
+func (wb *writeBehind) run() {
+	defer wb.running.Done()
+	for {
+		select {
+		case <-wb.stopped:
+			wb.flush()
+			return
+		case <-wb.wakeup:
+		}
+
+		for {
+			entry, ok := wb.next()
+			if !ok {
+				break
+			}
+
+			if err := wb.apply(entry); err != nil {
+				backoff := syncBackoff(replicateRetryInterval, wb.maxBackoff, wb.failures)
+				slog.Error("error writing behind to backup store", "failures", wb.failures, "retry_in", backoff.String(), "error", err)
+				select {
+				case <-wb.stopped:
+					wb.flush()
+					return
+				case <-time.After(backoff):
+				}
+			}
+		}
+	}
+}
+
+// flush queued entries on stop, giving up on the first failure since backup is about to be closed
+func (wb *writeBehind) flush() {
+	for {
+		entry, ok := wb.next()
+		if !ok {
+			return
+		}
+		if err := wb.apply(entry); err != nil {
+			wb.lock.Lock()
+			slog.Error("error flushing backup store, queued changes lost", "changes", wb.depth, "error", err)
+			wb.lock.Unlock()
+			return
+		}
+	}
+}
+
+// next returns up to batch size changes from the head of the queue, or a meta entry
+func (wb *writeBehind) next() (writeBehindEntry, bool) {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+
+	if len(wb.entries) == 0 {
+		return writeBehindEntry{}, false
+	}
+
+	head := wb.entries[0]
+	if head.changes == nil {
+		return head, true
+	}
+
+	batch := writeBehindEntry{changes: make([]core.Change, 0, wb.batchSize), queued: head.queued}
+	for _, entry := range wb.entries {
+		room := wb.batchSize - len(batch.changes)
+		if entry.changes == nil || room == 0 {
+			break
+		}
+		if len(entry.changes) > room {
+			batch.changes = append(batch.changes, entry.changes[:room]...)
+			break
+		}
+		batch.changes = append(batch.changes, entry.changes...)
+	}
+	return batch, true
+}
+
+// apply entry to backup store and remove what was applied from the queue
+func (wb *writeBehind) apply(entry writeBehindEntry) error {
+	var applied int
+	var err error
+	if entry.changes == nil {
+		err = wb.backup.(core.MetaStore).SetMeta(entry.metaName, entry.metaValue)
+		if err == nil {
+			applied = 1
+		}
+	} else {
+		applied, err = applyStoreChanges(wb.backup, entry.changes)
+	}
+
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+
+	wb.dequeue(entry.changes == nil, applied)
+	if err != nil {
+		wb.failures++
+		wb.lastError = err.Error()
+		return err
+	}
+	wb.failures = 0
+	wb.lastError = ""
+	return nil
+}
+
+// dequeue applied changes from the head of the queue, called with lock held
+func (wb *writeBehind) dequeue(meta bool, applied int) {
+	if meta {
+		if applied > 0 {
+			wb.entries = wb.entries[1:]
+			wb.depth--
+		}
+	} else {
+		wb.applied += int64(applied)
+		wb.depth -= applied
+		for applied > 0 {
+			head := &wb.entries[0]
+			if applied < len(head.changes) {
+				head.changes = head.changes[applied:]
+				break
+			}
+			applied -= len(head.changes)
+			wb.entries = wb.entries[1:]
+		}
+	}
+	wb.room.Broadcast()
+}
+
+func (wb *writeBehind) status(now time.Time) writeBehindStatus {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+
+	status := writeBehindStatus{Enabled: true, Depth: wb.depth, Applied: wb.applied, Failures: wb.failures, LastError: wb.lastError}
+	if len(wb.entries) > 0 {
+		status.LagMs = int64(now.Sub(wb.entries[0].queued) / time.Millisecond)
+	}
+	return status
+}
+
+// backupQueueStore returns depth and lag of changes pending for the backup store
+func (ctx *Context) backupQueueStore(w http.ResponseWriter, r *http.Request, httpParams httprouter.Params) {
+	storeName := httpParams.ByName("store")
+	store, ok := ctx.store(storeName)
+
+	if !ok {
+		err := fmt.Sprintf("invalid or store %s not found", storeName)
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	status := writeBehindStatus{}
+	if store.writeBehind != nil {
+		status = store.writeBehind.status(time.Now())
+	}
+
+	jsRes, err := json.Marshal(status)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, jsRes)
+}
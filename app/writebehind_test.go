@@ -0,0 +1,121 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/awesomenix/keypropstore/core"
+)
+
+func TestWriteBehindFlushOnShutdown(t *testing.T) {
+	buf := []byte(`
+Port : 8080
+Stores :
+- local:
+    Backup : BoltDB
+    BackupDir : ./writebehindtest
+    BackupWriteBehind : true
+    BackupBatchSize : 2
+`)
+
+	os.RemoveAll("./writebehindtest")
+	defer os.RemoveAll("./writebehindtest")
+	defer os.Remove("./config.yml")
+	if err := ioutil.WriteFile("./config.yml", buf, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, err := CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(1 * time.Second)
+
+	const storeURL string = "http://127.0.0.1:8080/v1/store/local"
+	if err := postStore(storeURL+"/update", []byte(`{"m1": {"num": "6.13"}, "m2": {"num": "6.13"}, "m3": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	if err := postStore(storeURL+"/remove", []byte(`{"m2": {"num": "6.13"}}`)); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+
+	var status writeBehindStatus
+	if err := getJSON(storeURL+"/backupqueue", &status); err != nil {
+		t.Error(err)
+		DeleteContext(ctx)
+		return
+	}
+	if !status.Enabled {
+		t.Errorf("Expected write behind to be enabled, found %+v", status)
+	}
+
+	// changes still queued are flushed to backup on shutdown
+	store := ctx.stores["local"]
+	store.writeBehind.enqueue([]core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: "m4"}})
+	DeleteContext(ctx)
+
+	if status := store.writeBehind.status(time.Now()); status.Depth != 0 || status.Applied != 5 {
+		t.Errorf("Expected all 5 changes applied to backup, found %+v", status)
+	}
+
+	ctx, err = CreateContext("config", "./config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteContext(ctx)
+
+	time.Sleep(1 * time.Second)
+
+	testQueryKeys(storeURL+"/query", []string{"m1", "m3", "m4"}, t)
+}
+
+func TestWriteBehindQueueFull(t *testing.T) {
+	primary := &core.InMemoryStore{}
+	core.InitializeStore(primary, nil)
+	backup := &failingStore{failKey: "m1"}
+	core.InitializeStore(backup, nil)
+
+	store := &CoreStores{primary: primary, backup: backup, changes: core.NewChangeLog(100), sources: core.NewSourceIndex()}
+	store.writeBehind = newWriteBehind(backup, Store{BackupQueueSize: 2, BackupBatchSize: 1, SyncMaxBackoffSec: 1})
+	store.writeBehind.start()
+	defer store.writeBehind.stop()
+
+	// backup keeps failing m1, so the queue fills up
+	for _, key := range []string{"m1", "m2"} {
+		if err := store.applyChanges([]core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: key}}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- store.applyChanges([]core.Change{{Op: core.ChangeAdd, Property: "num:6.13", Key: "m3"}})
+	}()
+	select {
+	case err := <-done:
+		if err != errBackupQueueFull || writeErrorStatus(err) != 503 {
+			t.Errorf("Expected full backup queue rejected with 503, found %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected write to full backup queue not to block")
+		return
+	}
+
+	if keys, _ := primary.Query("num:6.13"); len(keys) != 2 {
+		t.Errorf("Expected rejected change not applied to primary, found %v", keys)
+	}
+	if status := store.writeBehind.status(time.Now()); status.Depth != 2 {
+		t.Errorf("Expected 2 queued changes, found %+v", status)
+	}
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// BackendFactory creates and initializes a store persisting to dir
+// decode fills the backend specific configuration struct from the store settings
+// and fails on settings the struct does not define
+type BackendFactory func(dir string, decode func(cfg interface{}) error) (Store, error)
+
+var backendsLock sync.RWMutex
+var backends = make(map[string]BackendFactory)
+
+// volatileBackends keep stores only in memory, losing every change on restart
+var volatileBackends = map[string]bool{"InMemory": true, "ShardedInMemory": true}
+
+// RegisterBackend makes a store backend available by name, usually called from init
+// Registering the same name twice or a nil factory panics
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if factory == nil {
+		panic("core: RegisterBackend factory is nil for " + name)
+	}
+	if _, ok := backends[name]; ok {
+		panic("core: RegisterBackend called twice for " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns sorted names of registered backends
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsBackend reports whether a backend is registered with name
+func IsBackend(name string) bool {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	_, ok := backends[name]
+	return ok
+}
+
+// IsDurableBackend reports whether a backend is registered with name and persists stores to dir
+// only durable backends make sense as backup of a primary store
+func IsDurableBackend(name string) bool {
+	return IsBackend(name) && !volatileBackends[name]
+}
+
+// CreateBackend creates store of registered backend name, unknown names are rejected
+// a nil decode leaves backend configuration at its defaults
+func CreateBackend(name, dir string, decode func(cfg interface{}) error) (Store, error) {
+	backendsLock.RLock()
+	factory, ok := backends[name]
+	backendsLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend %s, available backends %v", name, Backends())
+	}
+
+	if decode == nil {
+		decode = func(cfg interface{}) error { return nil }
+	}
+	return factory(dir, decode)
+}
+
+func init() {
+	RegisterBackend("InMemory", func(dir string, decode func(cfg interface{}) error) (Store, error) {
+		var opts struct{}
+		if err := decode(&opts); err != nil {
+			return nil, err
+		}
+		store := new(InMemoryStore)
+		return store, InitializeStore(store, nil)
+	})
+}
+
+// BackendName of store, type name for stores of unregistered backends
+func BackendName(s Store) string {
+	switch s.(type) {
+	case *InMemoryStore:
+		return "InMemory"
+	case *ShardedInMemoryStore:
+		return "ShardedInMemory"
+	case *TieredStore:
+		return "Tiered"
+	case *BoltStore:
+		return "BoltDB"
+	case *BadgerStore:
+		return "BadgerDB"
+	case *LevelDBStore:
+		return "LevelDB"
+	}
+	return fmt.Sprintf("%T", s)
+}
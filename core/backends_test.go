@@ -0,0 +1,46 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	type echoOptions struct {
+		Prefix string
+	}
+
+	RegisterBackend("TestEcho", func(dir string, decode func(cfg interface{}) error) (Store, error) {
+		var opts echoOptions
+		if err := decode(&opts); err != nil {
+			return nil, err
+		}
+		if opts.Prefix != "echo" {
+			t.Errorf("Expected decoded prefix echo, found %s", opts.Prefix)
+		}
+		return new(DummyEchoStore), nil
+	})
+
+	if !IsBackend("TestEcho") || !IsBackend("InMemory") || !IsBackend("BoltDB") || !IsBackend("BadgerDB") {
+		t.Errorf("Expected builtin and registered backends, found %v", Backends())
+	}
+
+	if !IsDurableBackend("BoltDB") || IsDurableBackend("InMemory") || IsDurableBackend("ShardedInMemory") || IsDurableBackend("BoltDb") {
+		t.Errorf("Expected only registered backends persisting to dir to be durable")
+	}
+
+	store, err := CreateBackend("TestEcho", "", func(cfg interface{}) error {
+		cfg.(*echoOptions).Prefix = "echo"
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := store.(*DummyEchoStore); !ok {
+		t.Errorf("Expected DummyEchoStore, found %T", store)
+	}
+
+	if _, err := CreateBackend("BoltDb", "", nil); err == nil {
+		t.Errorf("Expected unknown backend to be rejected")
+	}
+}
@@ -9,11 +9,34 @@ import (
 
 // Store (Key, Value), value in JSON format
 
+// badgerMetaPrefix separates meta blobs from store data in the same keyspace
+const badgerMetaPrefix string = "\x00keypropstore-meta:"
+
 // BadgerStore store for db
 type BadgerStore struct {
 	db *badger.DB
 }
 
+// BadgerBackendOptions settings of BadgerDB backend
+type BadgerBackendOptions struct {
+	SyncWrites bool
+}
+
+func init() {
+	RegisterBackend("BadgerDB", func(dir string, decode func(cfg interface{}) error) (Store, error) {
+		backendOpts := BadgerBackendOptions{SyncWrites: badger.DefaultOptions.SyncWrites}
+		if err := decode(&backendOpts); err != nil {
+			return nil, err
+		}
+		opts := badger.DefaultOptions
+		opts.Dir = dir
+		opts.ValueDir = dir
+		opts.SyncWrites = backendOpts.SyncWrites
+		store := new(BadgerStore)
+		return store, InitializeStore(store, opts)
+	})
+}
+
 // Initialize Store with custom configuration
 func (s *BadgerStore) Initialize(cfg Config) error {
 	var opts badger.Options
@@ -96,6 +119,52 @@ func (s *BadgerStore) Update(key, value string) error {
 	return nil
 }
 
+// Remove value from the list associated with key
+func (s *BadgerStore) Remove(key, value string) error {
+	value = strings.ToLower(value)
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		jsStoreValue, err := item.Value()
+		if err != nil {
+			return err
+		}
+
+		var storeList []string
+		if err := json.Unmarshal(jsStoreValue, &storeList); err != nil {
+			return err
+		}
+
+		keyList := make([]string, 0, len(storeList))
+		for _, storeValue := range storeList {
+			if storeValue != value {
+				keyList = append(keyList, storeValue)
+			}
+		}
+
+		// nothing to remove
+		if len(keyList) == len(storeList) {
+			return nil
+		}
+
+		if len(keyList) == 0 {
+			return txn.Delete([]byte(key))
+		}
+
+		jsValue, err := json.Marshal(keyList)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(key), jsValue)
+	})
+}
+
 // Query for key, return value would be a list of keys associated with the property
 func (s *BadgerStore) Query(key string) ([]string, error) {
 	var jsStoreValue []byte
@@ -136,6 +205,10 @@ func (s *BadgerStore) Serialize() (map[string][]string, error) {
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
 			key := item.Key()
+			// skip meta blobs, they are not part of the store data
+			if strings.HasPrefix(string(key), badgerMetaPrefix) {
+				continue
+			}
 			jsStoreValue, err := item.Value()
 			if err != nil {
 				return err
@@ -156,3 +229,71 @@ func (s *BadgerStore) Serialize() (map[string][]string, error) {
 
 	return store, nil
 }
+
+// Stats of store, read from a consistent view of the db
+func (s *BadgerStore) Stats(largest int) (StoreStats, error) {
+	collector := newStatsCollector("BadgerDB", largest)
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			// skip meta blobs, they are not part of the store data
+			if strings.HasPrefix(string(key), badgerMetaPrefix) {
+				continue
+			}
+			jsStoreValue, err := item.Value()
+			if err != nil {
+				return err
+			}
+			var keyList []string
+			if err := json.Unmarshal(jsStoreValue, &keyList); err != nil {
+				return err
+			}
+			collector.add(string(key), keyList)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return StoreStats{}, err
+	}
+
+	return collector.result(), nil
+}
+
+// DiskSize of LSM tree and value log
+func (s *BadgerStore) DiskSize() (int64, error) {
+	lsm, vlog := s.db.Size()
+	return lsm + vlog, nil
+}
+
+// GetMeta returns named blob, nil if not found
+func (s *BadgerStore) GetMeta(name string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(badgerMetaPrefix + name))
+		if err != nil {
+			return err
+		}
+		byteVal, err := item.Value()
+		if err != nil {
+			return err
+		}
+		value = append([]byte(nil), byteVal...)
+		return nil
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// SetMeta stores named blob under a reserved key prefix
+func (s *BadgerStore) SetMeta(name string, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(badgerMetaPrefix+name), value)
+	})
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/dgraph-io/badger"
@@ -26,6 +27,7 @@ func TestBadgerStoreSingleKey(t *testing.T) {
 	}
 
 	testStoreSingleKeyReturn(badgerStore, t)
+	testStoreStats(badgerStore, t)
 }
 
 func TestBadgerStoreMultipleKey(t *testing.T) {
@@ -80,3 +82,35 @@ func TestBadgerStoreSerializeDeSerialize(t *testing.T) {
 
 	testStoreSerializeDeSerialize(badgerStore, badgerStoreNew, t)
 }
+
+func TestBadgerStoreRemove(t *testing.T) {
+	directory := "./badgerdb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := badger.DefaultOptions
+	opts.Dir = directory
+	opts.ValueDir = directory
+
+	badgerStore := new(BadgerStore)
+	InitializeStore(badgerStore, opts)
+	defer ShutdownStore(badgerStore)
+	err := UpdateStore(badgerStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreRemove(badgerStore, t)
+	testMetaStore(badgerStore, t)
+
+	// meta blobs should not be part of the serialized store
+	jsStore, err := SerializeStore(badgerStore)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Contains(string(jsStore), "cursor") {
+		t.Errorf("Expected serialized store without meta, found %s", string(jsStore))
+	}
+}
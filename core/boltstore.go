@@ -3,12 +3,15 @@ package core
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 const boltBucket string = "keypropstore"
+const boltMetaBucket string = "keypropstore-meta"
 
 // BoltStore (Key, Value), value in JSON format
 type BoltStore struct {
@@ -22,6 +25,33 @@ type BoltStoreConfig struct {
 	Options *bolt.Options
 }
 
+// BoltBackendOptions settings of BoltDB backend
+type BoltBackendOptions struct {
+	// TimeoutSec waiting for the file lock, 0 waits indefinitely
+	TimeoutSec int
+	NoGrowSync bool
+}
+
+func init() {
+	RegisterBackend("BoltDB", func(dir string, decode func(cfg interface{}) error) (Store, error) {
+		var backendOpts BoltBackendOptions
+		if err := decode(&backendOpts); err != nil {
+			return nil, err
+		}
+		os.Mkdir(dir, os.ModePerm)
+		opts := &BoltStoreConfig{
+			Path: filepath.Join(dir, "boltdbstore"),
+			Mode: 600,
+			Options: &bolt.Options{
+				Timeout:    time.Duration(backendOpts.TimeoutSec) * time.Second,
+				NoGrowSync: backendOpts.NoGrowSync,
+			},
+		}
+		store := new(BoltStore)
+		return store, InitializeStore(store, opts)
+	})
+}
+
 // Initialize Store with custom configuration
 func (s *BoltStore) Initialize(cfg Config) error {
 	var opts *BoltStoreConfig
@@ -109,6 +139,50 @@ func (s *BoltStore) Update(key, value string) error {
 	return nil
 }
 
+// Remove value from the list associated with key
+func (s *BoltStore) Remove(key, value string) error {
+	value = strings.ToLower(value)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(boltBucket))
+		if err != nil {
+			return err
+		}
+
+		jsStoreValue := bucket.Get([]byte(key))
+		if jsStoreValue == nil {
+			return nil
+		}
+
+		var storeList []string
+		if err := json.Unmarshal(jsStoreValue, &storeList); err != nil {
+			return err
+		}
+
+		keyList := make([]string, 0, len(storeList))
+		for _, storeValue := range storeList {
+			if storeValue != value {
+				keyList = append(keyList, storeValue)
+			}
+		}
+
+		// nothing to remove
+		if len(keyList) == len(storeList) {
+			return nil
+		}
+
+		if len(keyList) == 0 {
+			return bucket.Delete([]byte(key))
+		}
+
+		jsValue, err := json.Marshal(keyList)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), jsValue)
+	})
+}
+
 // Query for key, return value would be a list of keys associated with the property
 func (s *BoltStore) Query(key string) ([]string, error) {
 	err := s.db.Update(func(tx *bolt.Tx) error {
@@ -179,3 +253,68 @@ func (s *BoltStore) Serialize() (map[string][]string, error) {
 
 	return store, nil
 }
+
+// Stats of store, read from a consistent view of the db
+func (s *BoltStore) Stats(largest int) (StoreStats, error) {
+	collector := newStatsCollector("BoltDB", largest)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key, jsStoreValue []byte) error {
+			var keyList []string
+			if err := json.Unmarshal(jsStoreValue, &keyList); err != nil {
+				return err
+			}
+			collector.add(string(key), keyList)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return StoreStats{}, err
+	}
+
+	return collector.result(), nil
+}
+
+// DiskSize of db file
+func (s *BoltStore) DiskSize() (int64, error) {
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size, err
+}
+
+// GetMeta returns named blob, nil if not found
+func (s *BoltStore) GetMeta(name string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltMetaBucket))
+		if bucket == nil {
+			return nil
+		}
+		// bolt values are only valid during the transaction
+		if byteVal := bucket.Get([]byte(name)); byteVal != nil {
+			value = append([]byte(nil), byteVal...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// SetMeta stores named blob in a bucket separate from the store data
+func (s *BoltStore) SetMeta(name string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(boltMetaBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), value)
+	})
+}
@@ -22,6 +22,10 @@ func TestBoltStoreSingleKey(t *testing.T) {
 	}
 
 	testStoreSingleKeyReturn(boltStore, t)
+	testStoreStats(boltStore, t)
+	if size, err := boltStore.DiskSize(); err != nil || size <= 0 {
+		t.Errorf("Expected disk size, found %d, %v", size, err)
+	}
 }
 
 func TestBoltStoreMultipleKey(t *testing.T) {
@@ -71,3 +75,23 @@ func TestBoltStoreSerializeDeSerialize(t *testing.T) {
 
 	testStoreSerializeDeSerialize(boltStore, boltStoreNew, t)
 }
+
+func TestBoltStoreRemove(t *testing.T) {
+	directory := "./boltdb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &BoltStoreConfig{directory, 600, nil}
+
+	boltStore := new(BoltStore)
+	InitializeStore(boltStore, opts)
+	defer ShutdownStore(boltStore)
+	err := UpdateStore(boltStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreRemove(boltStore, t)
+	testMetaStore(boltStore, t)
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ChangeAdd associates a key with a property
+const ChangeAdd string = "add"
+
+// ChangeRemove removes association of a key from a property
+const ChangeRemove string = "remove"
+
+// ErrCursorInvalid returned when a cursor was issued by a different change log
+// (e.g. remote store restarted) or points to changes no longer retained
+var ErrCursorInvalid = errors.New("change log cursor is invalid or expired")
+
+// Change is a single (property, key) association added to or removed from a store
+type Change struct {
+	Seq      uint64 `json:"seq"`
+	Op       string `json:"op"`
+	Property string `json:"property"`
+	Key      string `json:"key"`
+}
+
+// ChangeLog retains a bounded history of changes applied to a store
+// Readers track their position using an opaque cursor "epoch-seq"
+// epoch is unique for every change log, so cursors become invalid when the store restarts
+type ChangeLog struct {
+	epoch   string
+	seq     uint64
+	changes []Change
+	size    int
+	lock    sync.RWMutex
+}
+
+// NewChangeLog creates change log retaining last size changes
+func NewChangeLog(size int) *ChangeLog {
+	epoch := make([]byte, 8)
+	rand.Read(epoch)
+	return &ChangeLog{epoch: hex.EncodeToString(epoch), size: size}
+}
+
+// Append changes to the log, assigning each a sequence number
+func (l *ChangeLog) Append(changes []Change) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, change := range changes {
+		l.seq++
+		change.Seq = l.seq
+		l.changes = append(l.changes, change)
+	}
+
+	// drop the oldest changes beyond retention
+	if over := len(l.changes) - l.size; over > 0 {
+		l.changes = append(l.changes[:0:0], l.changes[over:]...)
+	}
+}
+
+// Cursor returns position after the last appended change
+func (l *ChangeLog) Cursor() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.cursor(l.seq)
+}
+
+// Since returns upto limit changes after cursor along with the cursor to continue from
+func (l *ChangeLog) Since(cursor string, limit int) ([]Change, string, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	seq, err := l.parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// oldest retained change should immediately follow the cursor
+	if len(l.changes) > 0 && l.changes[0].Seq > seq+1 {
+		return nil, "", ErrCursorInvalid
+	}
+
+	changes := make([]Change, 0)
+	for _, change := range l.changes {
+		if change.Seq <= seq {
+			continue
+		}
+		if limit > 0 && len(changes) == limit {
+			break
+		}
+		changes = append(changes, change)
+		seq = change.Seq
+	}
+
+	return changes, l.cursor(seq), nil
+}
+
+func (l *ChangeLog) cursor(seq uint64) string {
+	return fmt.Sprintf("%s-%d", l.epoch, seq)
+}
+
+func (l *ChangeLog) parseCursor(cursor string) (uint64, error) {
+	parts := strings.SplitN(cursor, "-", 2)
+	if len(parts) != 2 || parts[0] != l.epoch {
+		return 0, ErrCursorInvalid
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || seq > l.seq {
+		return 0, ErrCursorInvalid
+	}
+
+	return seq, nil
+}
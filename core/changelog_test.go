@@ -0,0 +1,82 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestChangeLogSince(t *testing.T) {
+	changeLog := NewChangeLog(10)
+	start := changeLog.Cursor()
+
+	changes, err := ParseUpdate(byt, ChangeAdd)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	changeLog.Append(changes)
+
+	res, cursor, err := changeLog.Since(start, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(res) != len(changes) {
+		t.Errorf("Expected %d changes, found %d", len(changes), len(res))
+		return
+	}
+
+	if cursor != changeLog.Cursor() {
+		t.Errorf("Expected cursor %s, found %s", changeLog.Cursor(), cursor)
+		return
+	}
+
+	// reading with limit should continue from the returned cursor
+	first, cursor, err := changeLog.Since(start, 2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rest, _, err := changeLog.Since(cursor, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(first) != 2 || len(first)+len(rest) != len(changes) {
+		t.Errorf("Expected %d changes across reads, found %d + %d", len(changes), len(first), len(rest))
+		return
+	}
+	if rest[0].Seq != first[1].Seq+1 {
+		t.Errorf("Expected seq %d to follow %d", rest[0].Seq, first[1].Seq)
+	}
+}
+
+func TestChangeLogInvalidCursor(t *testing.T) {
+	changeLog := NewChangeLog(2)
+	start := changeLog.Cursor()
+
+	changeLog.Append([]Change{
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m1"},
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m2"},
+		{Op: ChangeRemove, Property: "num:6.13", Key: "m1"},
+	})
+
+	// first change has been dropped from retention
+	if _, _, err := changeLog.Since(start, 0); err != ErrCursorInvalid {
+		t.Errorf("Expected expired cursor to be invalid, found %v", err)
+	}
+
+	// cursor from a different change log
+	if _, _, err := changeLog.Since(NewChangeLog(2).Cursor(), 0); err != ErrCursorInvalid {
+		t.Errorf("Expected foreign cursor to be invalid, found %v", err)
+	}
+
+	if _, _, err := changeLog.Since("garbage", 0); err != ErrCursorInvalid {
+		t.Errorf("Expected malformed cursor to be invalid, found %v", err)
+	}
+
+	res, _, err := changeLog.Since(changeLog.Cursor(), 0)
+	if err != nil || len(res) != 0 {
+		t.Errorf("Expected no changes at latest cursor, found %v, %v", res, err)
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+// estimated bytes of a dictionary string besides its contents,
+// string header, id map entry and reference count
+const dictionaryEntryOverhead int64 = 56
+
+// dictionary interns strings to integer ids, so a string shared by many posting lists is held once
+// strings are reference counted, ids of released strings are reused
+type dictionary struct {
+	ids   map[string]uint32
+	strs  []string
+	refs  []uint32
+	free  []uint32
+	bytes int64
+}
+
+func newDictionary() *dictionary {
+	return &dictionary{ids: make(map[string]uint32)}
+}
+
+// intern returns id of value, adding it if missing, every intern must be released
+func (d *dictionary) intern(value string) uint32 {
+	if id, ok := d.ids[value]; ok {
+		d.refs[id]++
+		return id
+	}
+
+	var id uint32
+	if len(d.free) > 0 {
+		id = d.free[len(d.free)-1]
+		d.free = d.free[:len(d.free)-1]
+		d.strs[id] = value
+		d.refs[id] = 1
+	} else {
+		id = uint32(len(d.strs))
+		d.strs = append(d.strs, value)
+		d.refs = append(d.refs, 1)
+	}
+	d.ids[value] = id
+	d.bytes += dictionaryEntryOverhead + int64(len(value))
+	return id
+}
+
+// lookup id of value without adding it
+func (d *dictionary) lookup(value string) (uint32, bool) {
+	id, ok := d.ids[value]
+	return id, ok
+}
+
+// release reference to id, dropping the string once unreferenced
+func (d *dictionary) release(id uint32) {
+	d.refs[id]--
+	if d.refs[id] > 0 {
+		return
+	}
+
+	value := d.strs[id]
+	delete(d.ids, value)
+	d.strs[id] = ""
+	d.free = append(d.free, id)
+	d.bytes -= dictionaryEntryOverhead + int64(len(value))
+}
+
+// value of id
+func (d *dictionary) value(id uint32) string {
+	return d.strs[id]
+}
+
+// size number of interned strings
+func (d *dictionary) size() int {
+	return len(d.ids)
+}
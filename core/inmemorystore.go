@@ -2,51 +2,190 @@ package core
 
 import (
 	"fmt"
+	"log"
 	"strings"
 	"sync"
+	"time"
 )
 
+// InMemoryStoreConfig optional write ahead log making the store durable without a backup store
+// WALDir empty disables the log, WALSync one of WALSyncAlways, WALSyncInterval or WALSyncNone
+// log is compacted into a snapshot after CompactThreshold changes or every CompactInterval
+type InMemoryStoreConfig struct {
+	WALDir           string
+	WALSync          string
+	SyncInterval     time.Duration
+	CompactThreshold int
+	CompactInterval  time.Duration
+}
+
+// InMemoryStoreUsage memory used by the store, bytes are estimated from string lengths and entry overheads
+type InMemoryStoreUsage struct {
+	Properties      int   `json:"properties"`
+	Keys            int   `json:"keys"`
+	Associations    int   `json:"associations"`
+	DictionaryBytes int64 `json:"dictionaryBytes"`
+	PostingBytes    int64 `json:"postingBytes"`
+	EstimatedBytes  int64 `json:"estimatedBytes"`
+}
+
+// estimated bytes of a posting list besides its entries and of each entry
+const postingListOverhead int64 = 64
+const postingEntryOverhead int64 = 12
+
 // InMemoryStore is Concurrent friendly Store
 // Map of Property and List of Keys associated with that property
+// properties and keys are interned into dictionaries, posting lists hold integer ids
+// so a key associated with many properties is held once
 type InMemoryStore struct {
-	store map[string]map[string]bool
-	lock  sync.RWMutex
+	store       map[uint32]map[uint32]struct{}
+	properties  *dictionary
+	keys        *dictionary
+	meta        map[string][]byte
+	lock        sync.RWMutex
+	wal         *writeAheadLog
+	opts        InMemoryStoreConfig
+	compactLock sync.Mutex
+	compact     chan struct{}
+	shutdown    chan struct{}
+	running     sync.WaitGroup
 }
 
-// Initialize Store with custom configuration
+// Initialize Store with custom configuration, replaying write ahead log if configured
 func (s *InMemoryStore) Initialize(cfg Config) error {
-	s.store = make(map[string]map[string]bool)
+	s.store = make(map[uint32]map[uint32]struct{})
+	s.properties = newDictionary()
+	s.keys = newDictionary()
+	s.meta = make(map[string][]byte)
+
+	if cfg == nil {
+		return nil
+	}
+	opts, ok := cfg.(*InMemoryStoreConfig)
+	if !ok {
+		return fmt.Errorf("InMemoryStore expects *InMemoryStoreConfig, found %T", cfg)
+	}
+	if opts.WALDir == "" {
+		return nil
+	}
+	s.opts = *opts
+
+	wal, err := openWAL(s.opts.WALDir, s.opts.WALSync)
+	if err != nil {
+		return err
+	}
+
+	err = wal.replay(func(record walRecord) {
+		switch record.Op {
+		case ChangeAdd:
+			s.update(record.Property, record.Key)
+		case ChangeRemove:
+			s.remove(record.Property, record.Key)
+		case walMetaOp:
+			s.meta[record.Property] = record.Meta
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	s.wal = wal
+	s.compact = make(chan struct{}, 1)
+	s.shutdown = make(chan struct{})
+	s.running.Add(1)
+	go s.maintainWAL()
 	return nil
 }
 
-// Shutdown -Not much to do since its inmemory
+// Shutdown flushes and closes write ahead log if configured
 func (s *InMemoryStore) Shutdown() error {
-	return nil
+	if s.wal == nil {
+		return nil
+	}
+	close(s.shutdown)
+	s.running.Wait()
+	return s.wal.close()
+}
+
+// Durable reports whether changes are logged and survive restarts
+func (s *InMemoryStore) Durable() bool {
+	return s.wal != nil
 }
 
 // Update key value pair
 func (s *InMemoryStore) Update(key, value string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	key = strings.ToLower(key)
 
-	if _, ok := s.store[key]; !ok {
-		s.store[key] = make(map[string]bool)
-		s.store[key][strings.ToLower(value)] = true
-		return nil
+	if err := s.logChange(walRecord{Op: ChangeAdd, Property: key, Key: value}); err != nil {
+		return err
+	}
+
+	s.update(key, value)
+	return nil
+}
+
+func (s *InMemoryStore) update(key, value string) {
+	key, value = strings.ToLower(key), strings.ToLower(value)
+
+	propertyID, ok := s.properties.lookup(key)
+	if !ok {
+		propertyID = s.properties.intern(key)
+		s.store[propertyID] = make(map[uint32]struct{})
+	}
+	keySet := s.store[propertyID]
+
+	if keyID, ok := s.keys.lookup(value); ok {
+		if _, ok := keySet[keyID]; ok {
+			return
+		}
 	}
+	keySet[s.keys.intern(value)] = struct{}{}
+}
 
-	s.store[key][strings.ToLower(value)] = true
+// Remove value from the list associated with key
+func (s *InMemoryStore) Remove(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
+	if err := s.logChange(walRecord{Op: ChangeRemove, Property: key, Key: value}); err != nil {
+		return err
+	}
+
+	s.remove(key, value)
 	return nil
 }
 
+func (s *InMemoryStore) remove(key, value string) {
+	propertyID, ok := s.properties.lookup(strings.ToLower(key))
+	if !ok {
+		return
+	}
+	keyID, ok := s.keys.lookup(strings.ToLower(value))
+	if !ok {
+		return
+	}
+
+	keySet := s.store[propertyID]
+	if _, ok := keySet[keyID]; !ok {
+		return
+	}
+	delete(keySet, keyID)
+	s.keys.release(keyID)
+
+	// drop empty properties so that querying them stops the search
+	if len(keySet) == 0 {
+		delete(s.store, propertyID)
+		s.properties.release(propertyID)
+	}
+}
+
 // Query for key, return value would be a list of keys associated with the property
 func (s *InMemoryStore) Query(key string) ([]string, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 	key = strings.ToLower(key)
-	keySet, ok := s.store[key]
+	propertyID, ok := s.properties.lookup(key)
 
 	if !ok {
 		// property may not, thats ok since we just have to return empty
@@ -54,10 +193,11 @@ func (s *InMemoryStore) Query(key string) ([]string, error) {
 		return nil, fmt.Errorf("Error querying property %s", key)
 	}
 
-	keyList := make([]string, 0)
+	keySet := s.store[propertyID]
+	keyList := make([]string, 0, len(keySet))
 
-	for key := range keySet {
-		keyList = append(keyList, key)
+	for keyID := range keySet {
+		keyList = append(keyList, s.keys.value(keyID))
 	}
 
 	return keyList, nil
@@ -68,15 +208,156 @@ func (s *InMemoryStore) Serialize() (map[string][]string, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	store := make(map[string][]string)
+	return s.serialize(), nil
+}
+
+// serialize properties with their keys, called with store locked
+func (s *InMemoryStore) serialize() map[string][]string {
+	store := make(map[string][]string, len(s.store))
 
-	for key, keySet := range s.store {
-		keyList := make([]string, 0)
-		for key := range keySet {
-			keyList = append(keyList, key)
+	for propertyID, keySet := range s.store {
+		keyList := make([]string, 0, len(keySet))
+		for keyID := range keySet {
+			keyList = append(keyList, s.keys.value(keyID))
 		}
-		store[key] = keyList
+		store[s.properties.value(propertyID)] = keyList
 	}
 
-	return store, nil
+	return store
+}
+
+// MemoryUsage reports number of properties, distinct keys and associations with estimated bytes
+func (s *InMemoryStore) MemoryUsage() InMemoryStoreUsage {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	usage := InMemoryStoreUsage{
+		Properties:      len(s.store),
+		Keys:            s.keys.size(),
+		DictionaryBytes: s.properties.bytes + s.keys.bytes,
+	}
+	for _, keySet := range s.store {
+		usage.Associations += len(keySet)
+	}
+	usage.PostingBytes = int64(usage.Properties)*postingListOverhead + int64(usage.Associations)*postingEntryOverhead
+	usage.EstimatedBytes = usage.DictionaryBytes + usage.PostingBytes
+	return usage
+}
+
+// Stats of store, distinct keys are the interned keys
+func (s *InMemoryStore) Stats(largest int) (StoreStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	collector := newStatsCollector("InMemory", largest)
+	for propertyID, keySet := range s.store {
+		collector.addCount(s.properties.value(propertyID), len(keySet))
+	}
+
+	stats := collector.stats
+	stats.Keys = s.keys.size()
+	return stats, nil
+}
+
+// GetMeta returns named blob, nil if not found
+func (s *InMemoryStore) GetMeta(name string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.meta[name], nil
+}
+
+// SetMeta stores named blob, lost on shutdown unless write ahead log is configured
+func (s *InMemoryStore) SetMeta(name string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.logChange(walRecord{Op: walMetaOp, Property: name, Meta: value}); err != nil {
+		return err
+	}
+
+	s.meta[name] = value
+	return nil
+}
+
+// logChange appends to write ahead log before the change is applied, called with store locked
+func (s *InMemoryStore) logChange(record walRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+
+	if err := s.wal.append(record); err != nil {
+		return err
+	}
+
+	if s.opts.CompactThreshold > 0 && s.wal.size() >= s.opts.CompactThreshold {
+		select {
+		case s.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Compact write ahead log into a snapshot of the store
+// store is locked only while copying it, snapshot is written concurrently with updates
+func (s *InMemoryStore) Compact() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+
+	s.lock.Lock()
+	if err := s.wal.rotate(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	snapshot := walSnapshot{Store: s.serialize(), Meta: make(map[string][]byte)}
+	for name, value := range s.meta {
+		snapshot.Meta[name] = value
+	}
+	s.lock.Unlock()
+
+	return s.wal.writeSnapshot(snapshot)
+}
+
+// maintainWAL fsyncs and compacts write ahead log in background
+func (s *InMemoryStore) maintainWAL() {
+	defer s.running.Done()
+
+	var syncTick, compactTick <-chan time.Time
+	if s.opts.WALSync == WALSyncInterval && s.opts.SyncInterval > 0 {
+		ticker := time.NewTicker(s.opts.SyncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	if s.opts.CompactInterval > 0 {
+		ticker := time.NewTicker(s.opts.CompactInterval)
+		defer ticker.Stop()
+		compactTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-syncTick:
+			if err := s.wal.flush(); err != nil {
+				log.Printf("Error syncing write ahead log %s: %v\n", s.opts.WALDir, err)
+			}
+		case <-compactTick:
+			if s.wal.size() == 0 {
+				continue
+			}
+			if err := s.Compact(); err != nil {
+				log.Printf("Error compacting write ahead log %s: %v\n", s.opts.WALDir, err)
+			}
+		case <-s.compact:
+			if err := s.Compact(); err != nil {
+				log.Printf("Error compacting write ahead log %s: %v\n", s.opts.WALDir, err)
+			}
+		}
+	}
 }
@@ -1,6 +1,12 @@
 package core
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -15,6 +21,7 @@ func TestInMemStoreSingleKey(t *testing.T) {
 	}
 
 	testStoreSingleKeyReturn(inMemStore, t)
+	testStoreStats(inMemStore, t)
 }
 
 func TestInMemStoreMultiple(t *testing.T) {
@@ -66,3 +73,307 @@ func BenchmarkInMemStoreUpdateQuery(b *testing.B) {
 		}
 	}
 }
+
+func TestInMemStoreRemove(t *testing.T) {
+	inMemStore := &InMemoryStore{}
+	InitializeStore(inMemStore, nil)
+	defer ShutdownStore(inMemStore)
+	err := UpdateStore(inMemStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreRemove(inMemStore, t)
+	testMetaStore(inMemStore, t)
+}
+
+func TestInMemStoreMemoryUsage(t *testing.T) {
+	inMemStore := &InMemoryStore{}
+	InitializeStore(inMemStore, nil)
+	defer ShutdownStore(inMemStore)
+	err := UpdateStore(inMemStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	usage := inMemStore.MemoryUsage()
+	if usage.Properties != 5 || usage.Keys != 4 || usage.Associations != 8 || usage.EstimatedBytes <= 0 {
+		t.Errorf("Expected 5 properties, 4 keys and 8 associations, found %+v", usage)
+	}
+
+	// released keys leave the dictionary, their ids are reused
+	inMemStore.Remove("key1:asdasdb", "m4")
+	inMemStore.Update("key1:b", "m5")
+	usage = inMemStore.MemoryUsage()
+	if usage.Properties != 4 || usage.Keys != 4 || usage.Associations != 8 {
+		t.Errorf("Expected 4 properties, 4 keys and 8 associations, found %+v", usage)
+	}
+	if len(inMemStore.keys.strs) != 4 {
+		t.Errorf("Expected released key id reused, found %v", inMemStore.keys.strs)
+	}
+
+	testStoreSingleKeyReturn(inMemStore, t)
+}
+
+// benchmarkStoreHeap loads machines each with properties drawn from a fixed set of names and values,
+// every association carrying its own copy of the machine name as if decoded from an update
+func benchmarkStoreHeap(newStore func() Store, b *testing.B) {
+	const machines = 2000
+	const properties = 200
+
+	// heap could shrink between the readings, e.g. when garbage of a previous iteration is collected
+	var heapBytes int64
+	for n := 0; n < b.N; n++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		s := newStore()
+		for m := 0; m < machines; m++ {
+			for p := 0; p < properties; p++ {
+				property := fmt.Sprintf("property%03d:value%d", p, m%(p+2))
+				s.Update(property, fmt.Sprintf("machine-%05d.westus2.compute.example.com", m))
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		heapBytes += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+		runtime.KeepAlive(s)
+		ShutdownStore(s)
+	}
+	b.ReportMetric(float64(heapBytes)/float64(b.N)/(1<<20), "heapMB/op")
+}
+
+// BenchmarkInMemStoreHeap interned keys, compare against BenchmarkStringInMemStoreHeap
+func BenchmarkInMemStoreHeap(b *testing.B) {
+	benchmarkStoreHeap(func() Store {
+		inMemStore := &InMemoryStore{}
+		InitializeStore(inMemStore, nil)
+		return inMemStore
+	}, b)
+}
+
+// stringInMemStore InMemoryStore as it was before interning, holding key strings per property
+type stringInMemStore struct {
+	store map[string]map[string]bool
+	lock  sync.RWMutex
+}
+
+func (s *stringInMemStore) Initialize(cfg Config) error {
+	s.store = make(map[string]map[string]bool)
+	return nil
+}
+
+func (s *stringInMemStore) Shutdown() error {
+	return nil
+}
+
+func (s *stringInMemStore) Update(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key = strings.ToLower(key)
+	if _, ok := s.store[key]; !ok {
+		s.store[key] = make(map[string]bool)
+	}
+	s.store[key][strings.ToLower(value)] = true
+	return nil
+}
+
+func (s *stringInMemStore) Remove(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key = strings.ToLower(key)
+	delete(s.store[key], strings.ToLower(value))
+	if len(s.store[key]) == 0 {
+		delete(s.store, key)
+	}
+	return nil
+}
+
+func (s *stringInMemStore) Query(key string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keySet, ok := s.store[strings.ToLower(key)]
+	if !ok {
+		return nil, fmt.Errorf("Error querying property %s", key)
+	}
+	keyList := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keyList = append(keyList, key)
+	}
+	return keyList, nil
+}
+
+func (s *stringInMemStore) Serialize() (map[string][]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	store := make(map[string][]string, len(s.store))
+	for property, keySet := range s.store {
+		for key := range keySet {
+			store[property] = append(store[property], key)
+		}
+	}
+	return store, nil
+}
+
+func BenchmarkStringInMemStoreHeap(b *testing.B) {
+	benchmarkStoreHeap(func() Store {
+		stringStore := &stringInMemStore{}
+		InitializeStore(stringStore, nil)
+		return stringStore
+	}, b)
+}
+
+func reopenInMemStore(s *InMemoryStore, opts *InMemoryStoreConfig, t *testing.T) *InMemoryStore {
+	if err := ShutdownStore(s); err != nil {
+		t.Fatal(err)
+	}
+	reopened := &InMemoryStore{}
+	if err := InitializeStore(reopened, opts); err != nil {
+		t.Fatal(err)
+	}
+	return reopened
+}
+
+func TestInMemStoreWALReopen(t *testing.T) {
+	directory := "./inmemwal"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &InMemoryStoreConfig{WALDir: directory, WALSync: WALSyncAlways}
+	inMemStore := &InMemoryStore{}
+	if err := InitializeStore(inMemStore, opts); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := UpdateStore(inMemStore, byt); err != nil {
+		t.Error(err)
+		return
+	}
+
+	inMemStore = reopenInMemStore(inMemStore, opts, t)
+	testStoreSingleKeyReturn(inMemStore, t)
+
+	// changes after compaction are replayed on top of the snapshot
+	if err := inMemStore.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	testStoreRemove(inMemStore, t)
+	testMetaStore(inMemStore, t)
+
+	inMemStore = reopenInMemStore(inMemStore, opts, t)
+	defer ShutdownStore(inMemStore)
+	testStoreMultipleKeyRemoved(inMemStore, t)
+
+	if value, _ := inMemStore.GetMeta("cursor"); string(value) != "abc-1" {
+		t.Errorf("Expected meta to survive restart, found %s", string(value))
+	}
+}
+
+func TestInMemStoreWALTornTail(t *testing.T) {
+	directory := "./inmemwaltorn"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &InMemoryStoreConfig{WALDir: directory, WALSync: WALSyncNone}
+	inMemStore := &InMemoryStore{}
+	if err := InitializeStore(inMemStore, opts); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := UpdateStore(inMemStore, byt); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ShutdownStore(inMemStore); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// crash in the middle of appending a record
+	logFile, err := os.OpenFile(filepath.Join(directory, walLogFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	logFile.WriteString(`{"op":"remove","property":"num:6.`)
+	logFile.Close()
+
+	inMemStore = &InMemoryStore{}
+	if err := InitializeStore(inMemStore, opts); err != nil {
+		t.Error(err)
+		return
+	}
+	testStoreSingleKeyReturn(inMemStore, t)
+
+	// torn tail is truncated, so records appended afterwards are replayed
+	if err := inMemStore.Remove("strs:a", "m1"); err != nil {
+		t.Error(err)
+		return
+	}
+	inMemStore = reopenInMemStore(inMemStore, opts, t)
+	defer ShutdownStore(inMemStore)
+	testStoreMultipleKeyRemoved(inMemStore, t)
+}
+
+func TestInMemStoreWALCorrupt(t *testing.T) {
+	directory := "./inmemwalcorrupt"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &InMemoryStoreConfig{WALDir: directory, WALSync: WALSyncNone}
+	inMemStore := &InMemoryStore{}
+	if err := InitializeStore(inMemStore, opts); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := UpdateStore(inMemStore, byt); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ShutdownStore(inMemStore); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// corrupt record followed by a complete one is not a torn tail
+	logPath := filepath.Join(directory, walLogFile)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	logFile.WriteString("{\"op\":\"remove\",\"prop\x00\n{\"op\":\"remove\",\"property\":\"strs:a\",\"key\":\"m1\"}\n")
+	logFile.Close()
+	before, _ := os.Stat(logPath)
+
+	if err := InitializeStore(&InMemoryStore{}, opts); err == nil {
+		t.Errorf("Expected replay of corrupt write ahead log to fail")
+	}
+	if after, _ := os.Stat(logPath); after.Size() != before.Size() {
+		t.Errorf("Expected corrupt write ahead log kept, size %d truncated to %d", before.Size(), after.Size())
+	}
+
+	if err := InitializeStore(&InMemoryStore{}, &BoltStoreConfig{}); err == nil {
+		t.Errorf("Expected configuration of another store refused")
+	}
+}
+
+func testStoreMultipleKeyRemoved(s Store, t *testing.T) {
+	keys, err := s.Query("strs:a")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(keys) != 1 || keys[0] != "m3" {
+		t.Errorf("Expected only m3 after restart, found %v", keys)
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 // Config provides a interface for stores to have additional config provided during initialization
@@ -14,10 +15,18 @@ type Store interface {
 	Initialize(cfg Config) error
 	Shutdown() error
 	Update(key, value string) error
+	Remove(key, value string) error
 	Query(key string) ([]string, error)
 	Serialize() (map[string][]string, error)
 }
 
+// MetaStore is implemented by stores which can persist small named blobs
+// outside of the (property, keys) data, e.g. sync cursors of aggregate stores
+type MetaStore interface {
+	GetMeta(name string) ([]byte, error)
+	SetMeta(name string, value []byte) error
+}
+
 // InitializeStore with optional configuration
 func InitializeStore(s Store, cfg Config) error {
 	return s.Initialize(cfg)
@@ -35,18 +44,100 @@ func ShutdownStore(s Store) error {
 // To
 // {"num:6.13" : ["m1", m2"], "strs:a" : ["m1"], "key1:b" : ["m1"], "key1:bddd" : ["m2"]}
 func UpdateStore(s Store, byt []byte) error {
+	changes, err := ParseUpdate(byt, ChangeAdd)
+
+	if err != nil {
+		return err
+	}
+
+	return ApplyChanges(s, changes)
+}
+
+// RemoveStore called with list of Key and properties to be disassociated
+// uses same JSON format as UpdateStore
+func RemoveStore(s Store, byt []byte) error {
+	changes, err := ParseUpdate(byt, ChangeRemove)
+
+	if err != nil {
+		return err
+	}
+
+	return ApplyChanges(s, changes)
+}
+
+// ParseUpdate converts Key and Associated properties JSON to list of changes with op
+// {"m1": {"num": "6.13"}} To [{op, "num:6.13", "m1"}]
+func ParseUpdate(byt []byte, op string) ([]Change, error) {
 	var dat map[string]map[string]string
 
 	if err := json.Unmarshal(byt, &dat); err != nil {
-		return err
+		return nil, err
 	}
 
+	changes := make([]Change, 0)
+
 	for key, value := range dat {
 		for valkey, valval := range value {
-			keyval := GenerateKey(valkey, valval)
-			if err := s.Update(keyval, key); err != nil {
-				return err
-			}
+			changes = append(changes, Change{Op: op, Property: GenerateKey(valkey, valval), Key: key})
+		}
+	}
+
+	return changes, nil
+}
+
+// ParseSerialized converts serialized store JSON to list of add changes
+// {"num:6.13" : ["m1", "m2"]} To [{add, "num:6.13", "m1"}, {add, "num:6.13", "m2"}]
+func ParseSerialized(jsBuffer []byte) ([]Change, error) {
+	var keyPropStore map[string][]string
+
+	if err := json.Unmarshal(jsBuffer, &keyPropStore); err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0)
+
+	for key, valueArray := range keyPropStore {
+		for _, value := range valueArray {
+			changes = append(changes, Change{Op: ChangeAdd, Property: key, Key: value})
+		}
+	}
+
+	return changes, nil
+}
+
+// ValidateChanges checks every change has a known operation, property and key
+func ValidateChanges(changes []Change) error {
+	for _, change := range changes {
+		if change.Op != ChangeAdd && change.Op != ChangeRemove {
+			return fmt.Errorf("Invalid change operation %s", change.Op)
+		}
+		if len(change.Property) == 0 || len(change.Key) == 0 {
+			return fmt.Errorf("Invalid change %s with empty property or key", change.Op)
+		}
+	}
+
+	return nil
+}
+
+// ApplyChanges adds or removes each (property, key) association in order
+// stores implementing BatchStore apply all of the changes at once
+func ApplyChanges(s Store, changes []Change) error {
+	if batchStore, ok := s.(BatchStore); ok {
+		return batchStore.ApplyBatch(changes)
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Op {
+		case ChangeAdd:
+			err = s.Update(change.Property, change.Key)
+		case ChangeRemove:
+			err = s.Remove(change.Property, change.Key)
+		default:
+			err = fmt.Errorf("Invalid change operation %s", change.Op)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
@@ -57,8 +148,26 @@ func UpdateStore(s Store, byt []byte) error {
 // Properties are AND only, if an OR is required, query multiple times
 // OR could be supported, but keeping it simple for now
 func QueryStore(s Store, jsQuery []byte) ([]byte, error) {
-	keys := make([]string, 0)
+	properties, err := ParseQuery(jsQuery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := QueryProperties(s, properties)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(keys)
 
+	return b, err
+}
+
+// ParseQuery converts query JSON to list of properties
+// {"num": "6.13","strs": "a"} To ["num:6.13", "strs:a"]
+func ParseQuery(jsQuery []byte) ([]string, error) {
 	var query map[string]string
 
 	if err := json.Unmarshal(jsQuery, &query); err != nil {
@@ -71,7 +180,14 @@ func QueryStore(s Store, jsQuery []byte) ([]byte, error) {
 		q = append(q, GenerateKey(key, val))
 	}
 
-	for _, val := range q {
+	return q, nil
+}
+
+// QueryProperties returns keys associated with all of the properties
+func QueryProperties(s Store, properties []string) ([]string, error) {
+	keys := make([]string, 0)
+
+	for _, val := range properties {
 		keyList, err := s.Query(val)
 
 		if err != nil {
@@ -86,9 +202,7 @@ func QueryStore(s Store, jsQuery []byte) ([]byte, error) {
 		keys = ArrayIntersect(keys, keyList)
 	}
 
-	b, err := json.Marshal(keys)
-
-	return b, err
+	return keys, nil
 }
 
 // SerializeStore to JSON
@@ -108,19 +222,11 @@ func SerializeStore(s Store) ([]byte, error) {
 // useful to restore store or for updating alternate store
 // {"key1" : {"propkey1" : "propvalue1", "propkey2" : "propvalue2"}, "key2" ...}
 func DeSerializeStore(s Store, jsBuffer []byte) error {
-	var keyPropStore map[string][]string
+	changes, err := ParseSerialized(jsBuffer)
 
-	if err := json.Unmarshal(jsBuffer, &keyPropStore); err != nil {
+	if err != nil {
 		return err
 	}
 
-	for key, valueArray := range keyPropStore {
-		for _, value := range valueArray {
-			if err := s.Update(key, value); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
+	return ApplyChanges(s, changes)
 }
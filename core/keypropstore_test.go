@@ -23,6 +23,11 @@ func (s *DummyEchoStore) Update(key, value string) error {
 	return nil
 }
 
+func (s *DummyEchoStore) Remove(key, value string) error {
+	delete(s.store, key)
+	return nil
+}
+
 func (s *DummyEchoStore) Query(key string) ([]string, error) {
 	ret := s.store[key]
 	var res []string
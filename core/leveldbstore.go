@@ -0,0 +1,247 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// levelDBMetaPrefix separates meta blobs from store data in the same keyspace
+const levelDBMetaPrefix string = "\x00keypropstore-meta:"
+
+// LevelDBStore (Key, Value), value in JSON format
+// leveldb has no read-modify-write transactions, writes are serialized by the store
+type LevelDBStore struct {
+	db   *leveldb.DB
+	path string
+	lock sync.Mutex
+}
+
+// LevelDBStoreConfig configuration for path and options
+type LevelDBStoreConfig struct {
+	Path    string
+	Options *opt.Options
+}
+
+// LevelDBBackendOptions settings of LevelDB backend
+type LevelDBBackendOptions struct {
+	// SyncWrites fsyncs every write
+	SyncWrites bool
+	// BlockCacheMB size of the block cache, 0 uses leveldb default
+	BlockCacheMB int
+	// WriteBufferMB size of the memtable before compaction to disk, 0 uses leveldb default
+	WriteBufferMB int
+}
+
+func init() {
+	RegisterBackend("LevelDB", func(dir string, decode func(cfg interface{}) error) (Store, error) {
+		var backendOpts LevelDBBackendOptions
+		if err := decode(&backendOpts); err != nil {
+			return nil, err
+		}
+		opts := &LevelDBStoreConfig{
+			Path: dir,
+			Options: &opt.Options{
+				NoSync:             !backendOpts.SyncWrites,
+				BlockCacheCapacity: backendOpts.BlockCacheMB * opt.MiB,
+				WriteBuffer:        backendOpts.WriteBufferMB * opt.MiB,
+			},
+		}
+		store := new(LevelDBStore)
+		return store, InitializeStore(store, opts)
+	})
+}
+
+// Initialize Store with custom configuration
+func (s *LevelDBStore) Initialize(cfg Config) error {
+	var opts *LevelDBStoreConfig
+	if cfg != nil {
+		opts = cfg.(*LevelDBStoreConfig)
+	} else {
+		opts = &LevelDBStoreConfig{"./leveldb", nil}
+	}
+
+	var err error
+	s.path = opts.Path
+	s.db, err = leveldb.OpenFile(opts.Path, opts.Options)
+	return err
+}
+
+// Shutdown db, by closing all the open handles
+func (s *LevelDBStore) Shutdown() error {
+	return s.db.Close()
+}
+
+// Update db with key value pair
+func (s *LevelDBStore) Update(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	storeList, err := s.get(key)
+	if err != nil {
+		return err
+	}
+
+	value = strings.ToLower(value)
+
+	for _, storeValue := range storeList {
+		if storeValue == value {
+			return nil
+		}
+	}
+
+	// append the current value to JSON
+	jsValue, err := json.Marshal(append(storeList, value))
+	if err != nil {
+		return err
+	}
+
+	return s.db.Put([]byte(key), jsValue, nil)
+}
+
+// Remove value from the list associated with key
+func (s *LevelDBStore) Remove(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	storeList, err := s.get(key)
+	if err != nil {
+		return err
+	}
+
+	value = strings.ToLower(value)
+
+	keyList := make([]string, 0, len(storeList))
+	for _, storeValue := range storeList {
+		if storeValue != value {
+			keyList = append(keyList, storeValue)
+		}
+	}
+
+	// nothing to remove
+	if len(keyList) == len(storeList) {
+		return nil
+	}
+
+	if len(keyList) == 0 {
+		return s.db.Delete([]byte(key), nil)
+	}
+
+	jsValue, err := json.Marshal(keyList)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(key), jsValue, nil)
+}
+
+// get list of values associated with key, empty if key is not found
+func (s *LevelDBStore) get(key string) ([]string, error) {
+	jsStoreValue, err := s.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var storeList []string
+	if err := json.Unmarshal(jsStoreValue, &storeList); err != nil {
+		return nil, err
+	}
+	return storeList, nil
+}
+
+// Query for key, return value would be a list of keys associated with the property
+func (s *LevelDBStore) Query(key string) ([]string, error) {
+	// missing property is an error, stopping the search
+	jsStoreValue, err := s.db.Get([]byte(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deserialize the JSON value to string array
+	var keyList []string
+	if err := json.Unmarshal(jsStoreValue, &keyList); err != nil {
+		return nil, err
+	}
+
+	return keyList, nil
+}
+
+// Serialize store to backup, could be optionally compressed
+func (s *LevelDBStore) Serialize() (map[string][]string, error) {
+	store := make(map[string][]string)
+
+	// iterator reads a consistent snapshot of the db
+	it := s.db.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := string(it.Key())
+		// skip meta blobs, they are not part of the store data
+		if strings.HasPrefix(key, levelDBMetaPrefix) {
+			continue
+		}
+		// Deserialize the JSON value to string array
+		var keyList []string
+		if err := json.Unmarshal(it.Value(), &keyList); err != nil {
+			return nil, err
+		}
+		store[key] = keyList
+	}
+
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Stats of store, read from a consistent snapshot of the db
+func (s *LevelDBStore) Stats(largest int) (StoreStats, error) {
+	collector := newStatsCollector("LevelDB", largest)
+
+	it := s.db.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := string(it.Key())
+		// skip meta blobs, they are not part of the store data
+		if strings.HasPrefix(key, levelDBMetaPrefix) {
+			continue
+		}
+		var keyList []string
+		if err := json.Unmarshal(it.Value(), &keyList); err != nil {
+			return StoreStats{}, err
+		}
+		collector.add(key, keyList)
+	}
+
+	if err := it.Error(); err != nil {
+		return StoreStats{}, err
+	}
+
+	return collector.result(), nil
+}
+
+// DiskSize of files in db directory
+func (s *LevelDBStore) DiskSize() (int64, error) {
+	return dirSize(s.path)
+}
+
+// GetMeta returns named blob, nil if not found
+func (s *LevelDBStore) GetMeta(name string) ([]byte, error) {
+	value, err := s.db.Get([]byte(levelDBMetaPrefix+name), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// SetMeta stores named blob under a reserved key prefix
+func (s *LevelDBStore) SetMeta(name string, value []byte) error {
+	return s.db.Put([]byte(levelDBMetaPrefix+name), value, nil)
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLevelDBStoreSingleKey(t *testing.T) {
+	directory := "./leveldb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &LevelDBStoreConfig{directory, nil}
+
+	levelDBStore := new(LevelDBStore)
+	InitializeStore(levelDBStore, opts)
+	defer ShutdownStore(levelDBStore)
+	err := UpdateStore(levelDBStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreSingleKeyReturn(levelDBStore, t)
+	testStoreStats(levelDBStore, t)
+	if size, err := levelDBStore.DiskSize(); err != nil || size <= 0 {
+		t.Errorf("Expected disk size, found %d, %v", size, err)
+	}
+}
+
+func TestLevelDBStoreMultipleKey(t *testing.T) {
+	directory := "./leveldb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &LevelDBStoreConfig{directory, nil}
+
+	levelDBStore := new(LevelDBStore)
+	InitializeStore(levelDBStore, opts)
+	defer ShutdownStore(levelDBStore)
+	err := UpdateStore(levelDBStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreMultipleKeyReturn(levelDBStore, t)
+}
+
+func TestLevelDBStoreSerializeDeSerialize(t *testing.T) {
+	directory := "./leveldb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &LevelDBStoreConfig{directory, nil}
+
+	levelDBStore := new(LevelDBStore)
+	InitializeStore(levelDBStore, opts)
+	defer ShutdownStore(levelDBStore)
+	err := UpdateStore(levelDBStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	directoryNew := "./leveldbNew"
+	os.RemoveAll(directoryNew)
+	defer os.RemoveAll(directoryNew)
+
+	opts.Path = directoryNew
+
+	levelDBStoreNew := new(LevelDBStore)
+	InitializeStore(levelDBStoreNew, opts)
+	defer ShutdownStore(levelDBStoreNew)
+
+	testStoreSerializeDeSerialize(levelDBStore, levelDBStoreNew, t)
+}
+
+func TestLevelDBStoreRemove(t *testing.T) {
+	directory := "./leveldb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	opts := &LevelDBStoreConfig{directory, nil}
+
+	levelDBStore := new(LevelDBStore)
+	InitializeStore(levelDBStore, opts)
+	defer ShutdownStore(levelDBStore)
+	err := UpdateStore(levelDBStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreRemove(levelDBStore, t)
+	testMetaStore(levelDBStore, t)
+}
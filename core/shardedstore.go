@@ -0,0 +1,247 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// defaultShards number of shards when not configured
+const defaultShards int = 32
+
+// BatchStore is implemented by stores which apply a list of changes at once,
+// either all of the changes are applied or none and an error is returned
+type BatchStore interface {
+	ApplyBatch(changes []Change) error
+}
+
+// ShardedInMemoryStoreConfig number of shards properties are hashed to
+type ShardedInMemoryStoreConfig struct {
+	Shards int
+}
+
+// inMemoryShard properties hashed to the shard, guarded by its own lock
+type inMemoryShard struct {
+	store map[string]map[string]bool
+	lock  sync.RWMutex
+}
+
+// ShardedInMemoryStore is InMemoryStore with properties hashed to shards with separate locks
+// so concurrent updates to different properties don't contend, Serialize locks all shards
+// to take a consistent copy
+type ShardedInMemoryStore struct {
+	shards   []*inMemoryShard
+	meta     map[string][]byte
+	metaLock sync.RWMutex
+}
+
+func init() {
+	RegisterBackend("ShardedInMemory", func(dir string, decode func(cfg interface{}) error) (Store, error) {
+		var opts ShardedInMemoryStoreConfig
+		if err := decode(&opts); err != nil {
+			return nil, err
+		}
+		store := new(ShardedInMemoryStore)
+		return store, InitializeStore(store, &opts)
+	})
+}
+
+// Initialize Store with custom configuration
+func (s *ShardedInMemoryStore) Initialize(cfg Config) error {
+	shards := defaultShards
+	if cfg != nil && cfg.(*ShardedInMemoryStoreConfig).Shards > 0 {
+		shards = cfg.(*ShardedInMemoryStoreConfig).Shards
+	}
+
+	s.shards = make([]*inMemoryShard, shards)
+	for i := range s.shards {
+		s.shards[i] = &inMemoryShard{store: make(map[string]map[string]bool)}
+	}
+	s.meta = make(map[string][]byte)
+	return nil
+}
+
+// Shutdown -Not much to do since its inmemory
+func (s *ShardedInMemoryStore) Shutdown() error {
+	return nil
+}
+
+// shardIndex of lower cased property, fnv-1a hash
+func (s *ShardedInMemoryStore) shardIndex(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(s.shards)))
+}
+
+func (s *ShardedInMemoryStore) shard(key string) *inMemoryShard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// Update key value pair
+func (s *ShardedInMemoryStore) Update(key, value string) error {
+	key = strings.ToLower(key)
+	shard := s.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.update(key, strings.ToLower(value))
+	return nil
+}
+
+// Remove value from the list associated with key
+func (s *ShardedInMemoryStore) Remove(key, value string) error {
+	key = strings.ToLower(key)
+	shard := s.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.remove(key, strings.ToLower(value))
+	return nil
+}
+
+// ApplyBatch groups changes by shard and applies them holding each shard lock once
+// shards are locked in order for the whole batch, so Serialize never sees part of a batch
+func (s *ShardedInMemoryStore) ApplyBatch(changes []Change) error {
+	if err := ValidateChanges(changes); err != nil {
+		return err
+	}
+
+	groups := make([][]Change, len(s.shards))
+	for _, change := range changes {
+		change.Property = strings.ToLower(change.Property)
+		change.Key = strings.ToLower(change.Key)
+		index := s.shardIndex(change.Property)
+		groups[index] = append(groups[index], change)
+	}
+
+	for index, group := range groups {
+		if len(group) > 0 {
+			s.shards[index].lock.Lock()
+		}
+	}
+
+	for index, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		shard := s.shards[index]
+		for _, change := range group {
+			if change.Op == ChangeAdd {
+				shard.update(change.Property, change.Key)
+			} else {
+				shard.remove(change.Property, change.Key)
+			}
+		}
+		shard.lock.Unlock()
+	}
+
+	return nil
+}
+
+func (shard *inMemoryShard) update(key, value string) {
+	keySet, ok := shard.store[key]
+	if !ok {
+		keySet = make(map[string]bool)
+		shard.store[key] = keySet
+	}
+	keySet[value] = true
+}
+
+func (shard *inMemoryShard) remove(key, value string) {
+	keySet, ok := shard.store[key]
+	if !ok {
+		return
+	}
+
+	delete(keySet, value)
+
+	// drop empty properties so that querying them stops the search
+	if len(keySet) == 0 {
+		delete(shard.store, key)
+	}
+}
+
+// Query for key, return value would be a list of keys associated with the property
+func (s *ShardedInMemoryStore) Query(key string) ([]string, error) {
+	key = strings.ToLower(key)
+	shard := s.shard(key)
+
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	keySet, ok := shard.store[key]
+
+	if !ok {
+		// missing property stops the search since the intersection would be empty
+		return nil, fmt.Errorf("Error querying property %s", key)
+	}
+
+	keyList := make([]string, 0, len(keySet))
+
+	for key := range keySet {
+		keyList = append(keyList, key)
+	}
+
+	return keyList, nil
+}
+
+// Serialize store to backup, all shards are locked so the copy is consistent
+func (s *ShardedInMemoryStore) Serialize() (map[string][]string, error) {
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+	}
+	defer func() {
+		for _, shard := range s.shards {
+			shard.lock.RUnlock()
+		}
+	}()
+
+	store := make(map[string][]string)
+
+	for _, shard := range s.shards {
+		for key, keySet := range shard.store {
+			keyList := make([]string, 0, len(keySet))
+			for key := range keySet {
+				keyList = append(keyList, key)
+			}
+			store[key] = keyList
+		}
+	}
+
+	return store, nil
+}
+
+// Stats of store, shards are locked one at a time
+func (s *ShardedInMemoryStore) Stats(largest int) (StoreStats, error) {
+	collector := newStatsCollector("ShardedInMemory", largest)
+
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		for key, keySet := range shard.store {
+			for key := range keySet {
+				collector.keys[key] = struct{}{}
+			}
+			collector.addCount(key, len(keySet))
+		}
+		shard.lock.RUnlock()
+	}
+
+	return collector.result(), nil
+}
+
+// GetMeta returns named blob, nil if not found
+func (s *ShardedInMemoryStore) GetMeta(name string) ([]byte, error) {
+	s.metaLock.RLock()
+	defer s.metaLock.RUnlock()
+	return s.meta[name], nil
+}
+
+// SetMeta stores named blob, lost on shutdown
+func (s *ShardedInMemoryStore) SetMeta(name string, value []byte) error {
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	s.meta[name] = value
+	return nil
+}
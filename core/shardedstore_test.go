@@ -0,0 +1,157 @@
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedStoreSingleKey(t *testing.T) {
+	shardedStore := &ShardedInMemoryStore{}
+	InitializeStore(shardedStore, &ShardedInMemoryStoreConfig{Shards: 4})
+	defer ShutdownStore(shardedStore)
+	err := UpdateStore(shardedStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreSingleKeyReturn(shardedStore, t)
+	testStoreStats(shardedStore, t)
+	testStoreMultipleKeyReturn(shardedStore, t)
+}
+
+func TestShardedStoreRemove(t *testing.T) {
+	shardedStore := &ShardedInMemoryStore{}
+	InitializeStore(shardedStore, nil)
+	defer ShutdownStore(shardedStore)
+	err := UpdateStore(shardedStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreRemove(shardedStore, t)
+	testMetaStore(shardedStore, t)
+}
+
+func TestShardedStoreSerializeDeSerialize(t *testing.T) {
+	shardedStore := &ShardedInMemoryStore{}
+	InitializeStore(shardedStore, nil)
+	defer ShutdownStore(shardedStore)
+	err := UpdateStore(shardedStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	inMemStore := &InMemoryStore{}
+	InitializeStore(inMemStore, nil)
+	defer ShutdownStore(inMemStore)
+
+	testStoreSerializeDeSerialize(shardedStore, inMemStore, t)
+}
+
+func TestShardedStoreApplyBatch(t *testing.T) {
+	shardedStore := &ShardedInMemoryStore{}
+	InitializeStore(shardedStore, &ShardedInMemoryStoreConfig{Shards: 4})
+	defer ShutdownStore(shardedStore)
+
+	err := shardedStore.ApplyBatch([]Change{
+		{Op: ChangeAdd, Property: "Num:6.13", Key: "M1"},
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m2"},
+		{Op: ChangeRemove, Property: "num:6.13", Key: "m1"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys, err := shardedStore.Query("num:6.13")
+	if err != nil || len(keys) != 1 || keys[0] != "m2" {
+		t.Errorf("Expected changes to same property applied in order, found %v, %v", keys, err)
+	}
+
+	// invalid batch is rejected without applying any change
+	err = shardedStore.ApplyBatch([]Change{
+		{Op: ChangeAdd, Property: "num:6.14", Key: "m1"},
+		{Op: "replace", Property: "num:6.13", Key: "m3"},
+	})
+	if err == nil {
+		t.Errorf("Expected invalid batch to fail")
+	}
+	if keys, err := shardedStore.Query("num:6.14"); err == nil {
+		t.Errorf("Expected invalid batch not to be applied, found %v", keys)
+	}
+}
+
+// benchmarkParallelUpdateQuery reporters updating distinct properties while others query
+func benchmarkParallelUpdateQuery(s Store, b *testing.B) {
+	const properties int = 1024
+	names := make([]string, properties)
+	for i := range names {
+		names[i] = fmt.Sprintf("prop:%d", i)
+	}
+
+	var reporter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt64(&reporter, 1)
+		key := fmt.Sprintf("m%d", id)
+		n := int(id) * 7919
+		for pb.Next() {
+			property := names[n%properties]
+			if n%4 == 0 {
+				s.Query(property)
+			} else {
+				s.Update(property, key)
+			}
+			n++
+		}
+	})
+}
+
+func BenchmarkInMemStoreParallelUpdateQuery(b *testing.B) {
+	inMemStore := &InMemoryStore{}
+	InitializeStore(inMemStore, nil)
+	defer ShutdownStore(inMemStore)
+
+	benchmarkParallelUpdateQuery(inMemStore, b)
+}
+
+func BenchmarkShardedStoreParallelUpdateQuery(b *testing.B) {
+	shardedStore := &ShardedInMemoryStore{}
+	InitializeStore(shardedStore, nil)
+	defer ShutdownStore(shardedStore)
+
+	benchmarkParallelUpdateQuery(shardedStore, b)
+}
+
+// benchmarkParallelUpdateStore reporters sending complete updates through UpdateStore
+func benchmarkParallelUpdateStore(s Store, b *testing.B) {
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := UpdateStore(s, byt); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkInMemStoreParallelUpdateStore(b *testing.B) {
+	inMemStore := &InMemoryStore{}
+	InitializeStore(inMemStore, nil)
+	defer ShutdownStore(inMemStore)
+
+	benchmarkParallelUpdateStore(inMemStore, b)
+}
+
+func BenchmarkShardedStoreParallelUpdateStore(b *testing.B) {
+	shardedStore := &ShardedInMemoryStore{}
+	InitializeStore(shardedStore, nil)
+	defer ShutdownStore(shardedStore)
+
+	benchmarkParallelUpdateStore(shardedStore, b)
+}
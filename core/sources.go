@@ -0,0 +1,198 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// SourceIndex tracks which sources reported each (property, key) association
+// Used by aggregate stores merging multiple remote stores, an association is
+// removed from the store only when none of the sources report it anymore
+// Properties and keys are compared lower cased, same as InMemoryStore
+type SourceIndex struct {
+	// source -> property -> set of keys
+	sources map[string]map[string]map[string]bool
+	lock    sync.RWMutex
+}
+
+// NewSourceIndex creates an empty index
+func NewSourceIndex() *SourceIndex {
+	return &SourceIndex{sources: make(map[string]map[string]map[string]bool)}
+}
+
+// Apply records changes reported by source and returns changes to be applied to the store
+// additions are always applied, removals only of associations reported by this source
+// and not reported by any other source
+func (idx *SourceIndex) Apply(source string, changes []Change) []Change {
+	effective, _ := idx.ApplyWithUndo(source, changes)
+	return effective
+}
+
+// ApplyWithUndo same as Apply, along with a function reverting the recorded changes
+// used when applying the effective changes to the store fails
+func (idx *SourceIndex) ApplyWithUndo(source string, changes []Change) ([]Change, func()) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	sourceSet := idx.sourceSet(source)
+	effective := make([]Change, 0, len(changes))
+	recorded := make([]Change, 0)
+
+	for _, change := range changes {
+		property, key := strings.ToLower(change.Property), strings.ToLower(change.Key)
+		switch change.Op {
+		case ChangeAdd:
+			if _, ok := sourceSet[property]; !ok {
+				sourceSet[property] = make(map[string]bool)
+			}
+			if !sourceSet[property][key] {
+				recorded = append(recorded, Change{Op: ChangeAdd, Property: property, Key: key})
+			}
+			sourceSet[property][key] = true
+			effective = append(effective, change)
+		case ChangeRemove:
+			if !sourceSet[property][key] {
+				continue
+			}
+			idx.removeFromSource(sourceSet, property, key)
+			recorded = append(recorded, Change{Op: ChangeRemove, Property: property, Key: key})
+			if !idx.reportedByOthers(source, property, key) {
+				effective = append(effective, change)
+			}
+		}
+	}
+
+	undo := func() {
+		idx.lock.Lock()
+		defer idx.lock.Unlock()
+
+		sourceSet := idx.sourceSet(source)
+		for i := len(recorded) - 1; i >= 0; i-- {
+			change := recorded[i]
+			if change.Op == ChangeAdd {
+				idx.removeFromSource(sourceSet, change.Property, change.Key)
+				continue
+			}
+			if _, ok := sourceSet[change.Property]; !ok {
+				sourceSet[change.Property] = make(map[string]bool)
+			}
+			sourceSet[change.Property][change.Key] = true
+		}
+	}
+
+	return effective, undo
+}
+
+// Reconcile replaces the complete set of additions reported by source
+// returns the additions along with removals of associations the source no longer reports
+func (idx *SourceIndex) Reconcile(source string, full []Change) []Change {
+	effective, _ := idx.ReconcileWithUndo(source, full)
+	return effective
+}
+
+// ReconcileWithUndo same as Reconcile, along with a function restoring previously reported associations
+func (idx *SourceIndex) ReconcileWithUndo(source string, full []Change) ([]Change, func()) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	oldSet := idx.sourceSet(source)
+	newSet := make(map[string]map[string]bool)
+	effective := make([]Change, 0, len(full))
+
+	for _, change := range full {
+		if change.Op != ChangeAdd {
+			continue
+		}
+		property, key := strings.ToLower(change.Property), strings.ToLower(change.Key)
+		if _, ok := newSet[property]; !ok {
+			newSet[property] = make(map[string]bool)
+		}
+		newSet[property][key] = true
+		effective = append(effective, change)
+	}
+
+	idx.sources[source] = newSet
+
+	for property, keySet := range oldSet {
+		for key := range keySet {
+			if newSet[property][key] || idx.reportedByOthers(source, property, key) {
+				continue
+			}
+			effective = append(effective, Change{Op: ChangeRemove, Property: property, Key: key})
+		}
+	}
+
+	undo := func() {
+		idx.lock.Lock()
+		defer idx.lock.Unlock()
+		idx.sources[source] = oldSet
+	}
+
+	return effective, undo
+}
+
+// Serialize associations reported by source to JSON, same format as SerializeStore
+func (idx *SourceIndex) Serialize(source string) ([]byte, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	store := make(map[string][]string)
+	for property, keySet := range idx.sources[source] {
+		keyList := make([]string, 0, len(keySet))
+		for key := range keySet {
+			keyList = append(keyList, key)
+		}
+		store[property] = keyList
+	}
+
+	return json.Marshal(store)
+}
+
+// Restore associations reported by source from JSON produced by Serialize
+func (idx *SourceIndex) Restore(source string, jsBuffer []byte) error {
+	changes, err := ParseSerialized(jsBuffer)
+	if err != nil {
+		return err
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	sourceSet := make(map[string]map[string]bool)
+	for _, change := range changes {
+		property, key := strings.ToLower(change.Property), strings.ToLower(change.Key)
+		if _, ok := sourceSet[property]; !ok {
+			sourceSet[property] = make(map[string]bool)
+		}
+		sourceSet[property][key] = true
+	}
+	idx.sources[source] = sourceSet
+
+	return nil
+}
+
+func (idx *SourceIndex) sourceSet(source string) map[string]map[string]bool {
+	sourceSet, ok := idx.sources[source]
+	if !ok {
+		sourceSet = make(map[string]map[string]bool)
+		idx.sources[source] = sourceSet
+	}
+	return sourceSet
+}
+
+func (idx *SourceIndex) removeFromSource(sourceSet map[string]map[string]bool, property, key string) {
+	delete(sourceSet[property], key)
+	if len(sourceSet[property]) == 0 {
+		delete(sourceSet, property)
+	}
+}
+
+func (idx *SourceIndex) reportedByOthers(source, property, key string) bool {
+	for otherSource, otherSet := range idx.sources {
+		if otherSource != source && otherSet[property][key] {
+			return true
+		}
+	}
+	return false
+}
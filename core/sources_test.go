@@ -0,0 +1,112 @@
+package core
+
+import (
+	"testing"
+)
+
+func hasChange(changes []Change, op, property, key string) bool {
+	for _, change := range changes {
+		if change.Op == op && change.Property == property && change.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSourceIndexApply(t *testing.T) {
+	idx := NewSourceIndex()
+
+	idx.Apply("regionA", []Change{
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m1"},
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m2"},
+	})
+	idx.Apply("regionB", []Change{
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m2"},
+	})
+
+	effective := idx.Apply("regionA", []Change{
+		{Op: ChangeRemove, Property: "num:6.13", Key: "m1"},
+		{Op: ChangeRemove, Property: "num:6.13", Key: "m2"},
+		{Op: ChangeRemove, Property: "num:6.13", Key: "m3"},
+	})
+
+	if !hasChange(effective, ChangeRemove, "num:6.13", "m1") {
+		t.Errorf("Expected m1 only reported by regionA to be removed, found %v", effective)
+	}
+
+	if hasChange(effective, ChangeRemove, "num:6.13", "m2") {
+		t.Errorf("Expected m2 still reported by regionB to be kept, found %v", effective)
+	}
+
+	if hasChange(effective, ChangeRemove, "num:6.13", "m3") {
+		t.Errorf("Expected m3 never reported by regionA to be ignored, found %v", effective)
+	}
+}
+
+func TestSourceIndexReconcile(t *testing.T) {
+	idx := NewSourceIndex()
+
+	idx.Reconcile("regionA", []Change{
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m1"},
+		{Op: ChangeAdd, Property: "strs:a", Key: "m1"},
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m2"},
+	})
+	idx.Reconcile("regionB", []Change{
+		{Op: ChangeAdd, Property: "strs:a", Key: "m1"},
+	})
+
+	// m1 changed num and m2 disappeared from regionA
+	effective := idx.Reconcile("regionA", []Change{
+		{Op: ChangeAdd, Property: "num:6.14", Key: "m1"},
+	})
+
+	if !hasChange(effective, ChangeAdd, "num:6.14", "m1") {
+		t.Errorf("Expected new association to be added, found %v", effective)
+	}
+
+	if !hasChange(effective, ChangeRemove, "num:6.13", "m1") || !hasChange(effective, ChangeRemove, "num:6.13", "m2") {
+		t.Errorf("Expected associations no longer reported to be removed, found %v", effective)
+	}
+
+	if hasChange(effective, ChangeRemove, "strs:a", "m1") {
+		t.Errorf("Expected association reported by regionB to be kept, found %v", effective)
+	}
+}
+
+func TestSourceIndexSerializeRestore(t *testing.T) {
+	idx := NewSourceIndex()
+	idx.Apply("regionA", []Change{{Op: ChangeAdd, Property: "Num:6.13", Key: "M1"}})
+
+	jsSource, err := idx.Serialize("regionA")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	restored := NewSourceIndex()
+	if err := restored.Restore("regionA", jsSource); err != nil {
+		t.Error(err)
+		return
+	}
+
+	effective := restored.Reconcile("regionA", []Change{})
+	if !hasChange(effective, ChangeRemove, "num:6.13", "m1") {
+		t.Errorf("Expected restored association to be removed on reconcile, found %v", effective)
+	}
+}
+
+func TestSourceIndexApplyUndo(t *testing.T) {
+	idx := NewSourceIndex()
+	idx.Apply("regionA", []Change{{Op: ChangeAdd, Property: "num:6.13", Key: "m1"}})
+
+	_, undo := idx.ApplyWithUndo("regionA", []Change{
+		{Op: ChangeRemove, Property: "num:6.13", Key: "m1"},
+		{Op: ChangeAdd, Property: "num:6.13", Key: "m2"},
+	})
+	undo()
+
+	effective := idx.Reconcile("regionA", []Change{})
+	if !hasChange(effective, ChangeRemove, "num:6.13", "m1") || hasChange(effective, ChangeRemove, "num:6.13", "m2") {
+		t.Errorf("Expected undo to restore m1 and drop m2, found %v", effective)
+	}
+}
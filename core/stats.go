@@ -0,0 +1,101 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// PostingList property with the number of keys associated with it
+type PostingList struct {
+	Property string `json:"property"`
+	Keys     int    `json:"keys"`
+}
+
+// StoreStats size of a store, Largest holds the properties with most keys, largest first
+type StoreStats struct {
+	Backend      string        `json:"backend"`
+	Properties   int           `json:"properties"`
+	Keys         int           `json:"keys"`
+	Associations int           `json:"associations"`
+	Largest      []PostingList `json:"largest"`
+}
+
+// StatsStore is implemented by stores reporting their size, largest limits number of posting lists reported
+type StatsStore interface {
+	Stats(largest int) (StoreStats, error)
+}
+
+// DiskStore is implemented by stores persisting to disk, reporting bytes used
+type DiskStore interface {
+	DiskSize() (int64, error)
+}
+
+// statsCollector accumulates stats of stores iterating their posting lists
+type statsCollector struct {
+	stats   StoreStats
+	keys    map[string]struct{}
+	largest int
+}
+
+func newStatsCollector(backend string, largest int) *statsCollector {
+	return &statsCollector{stats: StoreStats{Backend: backend, Largest: make([]PostingList, 0)}, keys: make(map[string]struct{}), largest: largest}
+}
+
+// add posting list of property, keys are counted once across properties
+func (c *statsCollector) add(property string, keyList []string) {
+	for _, key := range keyList {
+		c.keys[key] = struct{}{}
+	}
+	c.addCount(property, len(keyList))
+}
+
+// addCount of keys associated with property, for stores counting distinct keys themselves
+func (c *statsCollector) addCount(property string, keys int) {
+	c.stats.Properties++
+	c.stats.Associations += keys
+	c.addLargest(property, keys)
+}
+
+// addLargest keeps largest posting lists, ties ordered by property
+func (c *statsCollector) addLargest(property string, keys int) {
+	if c.largest <= 0 {
+		return
+	}
+	largest := c.stats.Largest
+	if len(largest) == c.largest && !postingListBefore(keys, property, largest[len(largest)-1]) {
+		return
+	}
+	i := sort.Search(len(largest), func(i int) bool { return postingListBefore(keys, property, largest[i]) })
+	if len(largest) < c.largest {
+		largest = append(largest, PostingList{})
+	}
+	copy(largest[i+1:], largest[i:])
+	largest[i] = PostingList{Property: property, Keys: keys}
+	c.stats.Largest = largest
+}
+
+func postingListBefore(keys int, property string, list PostingList) bool {
+	return keys > list.Keys || keys == list.Keys && property < list.Property
+}
+
+// result with number of distinct keys
+func (c *statsCollector) result() StoreStats {
+	c.stats.Keys = len(c.keys)
+	return c.stats
+}
+
+// dirSize total bytes of files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
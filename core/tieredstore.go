@@ -0,0 +1,290 @@
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// estimated bookkeeping bytes of a cached property and of each of its keys
+const tieredEntryOverhead int64 = 64
+const tieredKeyOverhead int64 = 48
+
+// TieredStoreConfig backing store holding the complete data and memory budget of the cache
+type TieredStoreConfig struct {
+	Backing     Store
+	BudgetBytes int64
+}
+
+// TieredStoreStats cache effectiveness of a TieredStore
+type TieredStoreStats struct {
+	Properties  int   `json:"properties"`
+	Bytes       int64 `json:"bytes"`
+	BudgetBytes int64 `json:"budgetBytes"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Evictions   int64 `json:"evictions"`
+}
+
+// tieredEntry keys of a cached property
+type tieredEntry struct {
+	property string
+	keys     map[string]bool
+	size     int64
+}
+
+// tieredLoad property being read through from the backing store
+// stale when the property is written meanwhile, so the possibly outdated keys are not cached
+type tieredLoad struct {
+	readers int
+	stale   bool
+}
+
+// TieredStore caches recently queried properties in memory, bounded by a memory budget
+// with least recently used properties evicted, the backing store holds the complete data
+// writes go through to the backing store and update cached properties, misses read through
+// properties are cached as given, following the backing store, which keeps their case
+type TieredStore struct {
+	backing   Store
+	budget    int64
+	bytes     int64
+	lru       *list.List
+	entries   map[string]*list.Element
+	loading   map[string]*tieredLoad
+	stats     TieredStoreStats
+	lock      sync.Mutex
+	writeLock sync.Mutex
+}
+
+// Initialize Store with backing store, which must already be initialized
+func (s *TieredStore) Initialize(cfg Config) error {
+	opts, ok := cfg.(*TieredStoreConfig)
+	if !ok || opts.Backing == nil {
+		return fmt.Errorf("TieredStore requires a backing store")
+	}
+
+	s.backing = opts.Backing
+	s.budget = opts.BudgetBytes
+	s.lru = list.New()
+	s.entries = make(map[string]*list.Element)
+	s.loading = make(map[string]*tieredLoad)
+	return nil
+}
+
+// Shutdown backing store
+func (s *TieredStore) Shutdown() error {
+	return s.backing.Shutdown()
+}
+
+// Update key value pair
+// writes are serialized by writeLock, so cached properties are updated in the order of the backing store
+// while cache lock is only held to update the cache, so queries are not blocked by backing store I/O
+func (s *TieredStore) Update(key, value string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.backing.Update(key, value); err != nil {
+		return err
+	}
+
+	// backing stores lowercase keys
+	value = strings.ToLower(value)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.written(key)
+	if element, ok := s.entries[key]; ok {
+		entry := element.Value.(*tieredEntry)
+		if !entry.keys[value] {
+			entry.keys[value] = true
+			s.resize(entry, tieredKeyOverhead+int64(len(value)))
+		}
+	}
+	return nil
+}
+
+// Remove value from the list associated with key
+func (s *TieredStore) Remove(key, value string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if err := s.backing.Remove(key, value); err != nil {
+		return err
+	}
+
+	value = strings.ToLower(value)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.written(key)
+	if element, ok := s.entries[key]; ok {
+		entry := element.Value.(*tieredEntry)
+		if entry.keys[value] {
+			delete(entry.keys, value)
+			s.resize(entry, -(tieredKeyOverhead + int64(len(value))))
+		}
+		// empty properties are dropped by the backing store as well
+		if len(entry.keys) == 0 {
+			s.evict(element)
+		}
+	}
+	return nil
+}
+
+// written marks property read through concurrently as stale, called with cache locked
+func (s *TieredStore) written(property string) {
+	if load, ok := s.loading[property]; ok {
+		load.stale = true
+	}
+}
+
+// Query for key from cache, reading through to the backing store on a miss
+func (s *TieredStore) Query(key string) ([]string, error) {
+	s.lock.Lock()
+	element, ok := s.entries[key]
+	if ok {
+		s.stats.Hits++
+		s.lru.MoveToFront(element)
+		keyList := s.keyList(element)
+		s.lock.Unlock()
+		return keyList, nil
+	}
+	s.stats.Misses++
+	load, ok := s.loading[key]
+	if !ok {
+		load = &tieredLoad{}
+		s.loading[key] = load
+	}
+	load.readers++
+	s.lock.Unlock()
+
+	// missing property is an error, stopping the search
+	keyList, err := s.backing.Query(key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	load.readers--
+	if load.readers == 0 {
+		delete(s.loading, key)
+	}
+	if err != nil || load.stale {
+		return keyList, err
+	}
+	if _, ok := s.entries[key]; !ok {
+		// inserting a property larger than the budget evicts it right away
+		if element := s.insert(key, keyList); element.Value.(*tieredEntry).size > s.budget {
+			s.evict(element)
+		}
+	}
+	return keyList, nil
+}
+
+// keyList of cached property
+func (s *TieredStore) keyList(element *list.Element) []string {
+	entry := element.Value.(*tieredEntry)
+	keyList := make([]string, 0, len(entry.keys))
+	for key := range entry.keys {
+		keyList = append(keyList, key)
+	}
+	return keyList
+}
+
+// insert property at the front of the cache, evicting least recently used properties
+func (s *TieredStore) insert(property string, keyList []string) *list.Element {
+	entry := &tieredEntry{property: property, keys: make(map[string]bool, len(keyList)), size: tieredEntryOverhead + int64(len(property))}
+	for _, key := range keyList {
+		entry.keys[key] = true
+		entry.size += tieredKeyOverhead + int64(len(key))
+	}
+
+	element := s.lru.PushFront(entry)
+	s.entries[property] = element
+	s.bytes += entry.size
+	s.shrink(element)
+	return element
+}
+
+// resize cached entry and evict least recently used properties when over budget
+func (s *TieredStore) resize(entry *tieredEntry, delta int64) {
+	entry.size += delta
+	s.bytes += delta
+	s.shrink(nil)
+}
+
+// shrink evicts least recently used properties, except keep, until within budget
+func (s *TieredStore) shrink(keep *list.Element) {
+	for s.bytes > s.budget {
+		oldest := s.lru.Back()
+		if oldest == nil || oldest == keep {
+			return
+		}
+		s.evict(oldest)
+	}
+}
+
+func (s *TieredStore) evict(element *list.Element) {
+	entry := element.Value.(*tieredEntry)
+	s.lru.Remove(element)
+	delete(s.entries, entry.property)
+	s.bytes -= entry.size
+	s.stats.Evictions++
+}
+
+// Serialize complete store from the backing store
+func (s *TieredStore) Serialize() (map[string][]string, error) {
+	return s.backing.Serialize()
+}
+
+// CacheStats returns cache effectiveness
+func (s *TieredStore) CacheStats() TieredStoreStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.Properties = len(s.entries)
+	stats.Bytes = s.bytes
+	stats.BudgetBytes = s.budget
+	return stats
+}
+
+// Stats of the backing store holding the complete data
+func (s *TieredStore) Stats(largest int) (StoreStats, error) {
+	statsStore, ok := s.backing.(StatsStore)
+	if !ok {
+		return StoreStats{}, fmt.Errorf("backing store does not report stats")
+	}
+	stats, err := statsStore.Stats(largest)
+	stats.Backend = "Tiered(" + stats.Backend + ")"
+	return stats, err
+}
+
+// DiskSize of the backing store
+func (s *TieredStore) DiskSize() (int64, error) {
+	diskStore, ok := s.backing.(DiskStore)
+	if !ok {
+		return 0, fmt.Errorf("backing store does not report disk size")
+	}
+	return diskStore.DiskSize()
+}
+
+// GetMeta returns named blob of the backing store
+func (s *TieredStore) GetMeta(name string) ([]byte, error) {
+	metaStore, ok := s.backing.(MetaStore)
+	if !ok {
+		return nil, fmt.Errorf("backing store does not support meta")
+	}
+	return metaStore.GetMeta(name)
+}
+
+// SetMeta stores named blob in the backing store
+func (s *TieredStore) SetMeta(name string, value []byte) error {
+	metaStore, ok := s.backing.(MetaStore)
+	if !ok {
+		return fmt.Errorf("backing store does not support meta")
+	}
+	return metaStore.SetMeta(name, value)
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestTieredStore(directory string, budget int64) *TieredStore {
+	boltStore := new(BoltStore)
+	InitializeStore(boltStore, &BoltStoreConfig{directory, 600, nil})
+
+	tieredStore := new(TieredStore)
+	InitializeStore(tieredStore, &TieredStoreConfig{Backing: boltStore, BudgetBytes: budget})
+	return tieredStore
+}
+
+func TestTieredStoreSingleKey(t *testing.T) {
+	directory := "./tieredboltdb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	tieredStore := newTestTieredStore(directory, 1<<20)
+	defer ShutdownStore(tieredStore)
+	err := UpdateStore(tieredStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testStoreSingleKeyReturn(tieredStore, t)
+	testStoreStats(tieredStore, t)
+	testStoreMultipleKeyReturn(tieredStore, t)
+	testStoreRemove(tieredStore, t)
+	testMetaStore(tieredStore, t)
+}
+
+func TestTieredStoreEviction(t *testing.T) {
+	directory := "./tieredboltdb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	// budget holds a single property with two short keys
+	tieredStore := newTestTieredStore(directory, 300)
+	defer ShutdownStore(tieredStore)
+	err := UpdateStore(tieredStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, property := range []string{"num:6.13", "key1:b", "num:6.13"} {
+		if _, err := tieredStore.Query(property); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	stats := tieredStore.CacheStats()
+	if stats.Misses != 3 || stats.Hits != 0 || stats.Evictions < 2 || stats.Bytes > stats.BudgetBytes {
+		t.Errorf("Expected every query to miss with the budget holding a single property, found %+v", stats)
+	}
+
+	// cached property is updated by writes
+	if err := tieredStore.Update("num:6.13", "M3"); err != nil {
+		t.Error(err)
+		return
+	}
+	keys, err := tieredStore.Query("num:6.13")
+	if err != nil || len(keys) != 3 {
+		t.Errorf("Expected write through to update cached property, found %v, %v", keys, err)
+	}
+	if stats := tieredStore.CacheStats(); stats.Hits != 1 {
+		t.Errorf("Expected query to hit cache, found %+v", stats)
+	}
+
+	// removing the last key drops the property from cache and backing store
+	for _, key := range []string{"m1", "m2", "m3"} {
+		if err := tieredStore.Remove("num:6.13", key); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if keys, err := tieredStore.Query("num:6.13"); err == nil {
+		t.Errorf("Expected removed property to be missing, found %v", keys)
+	}
+}
+
+func TestTieredStoreLargeProperty(t *testing.T) {
+	directory := "./tieredboltdb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	// property larger than the budget is served but not cached
+	tieredStore := newTestTieredStore(directory, 10)
+	defer ShutdownStore(tieredStore)
+	err := UpdateStore(tieredStore, byt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys, err := tieredStore.Query("num:6.13")
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Expected property read through from backing store, found %v, %v", keys, err)
+	}
+	if stats := tieredStore.CacheStats(); stats.Properties != 0 || stats.Bytes != 0 {
+		t.Errorf("Expected property over budget not cached, found %+v", stats)
+	}
+}
+
+func TestTieredStoreMixedCase(t *testing.T) {
+	directory := "./tieredboltdb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	// properties written to bolt before it was cached keep their case
+	tieredStore := newTestTieredStore(directory, 1<<20)
+	defer ShutdownStore(tieredStore)
+	if err := tieredStore.backing.Update("Num:6.13", "M1"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		keys, err := tieredStore.Query("Num:6.13")
+		if err != nil || len(keys) != 1 || keys[0] != "m1" {
+			t.Errorf("Expected mixed case property read from backing store, found %v, %v", keys, err)
+		}
+	}
+	if err := tieredStore.Remove("Num:6.13", "M1"); err != nil {
+		t.Error(err)
+		return
+	}
+	if keys, err := tieredStore.backing.Query("Num:6.13"); err == nil {
+		t.Errorf("Expected mixed case property removed from backing store, found %v", keys)
+	}
+}
+
+// blockingBackend blocks queries until released
+type blockingBackend struct {
+	Store
+	querying chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingBackend) Query(key string) ([]string, error) {
+	s.querying <- struct{}{}
+	<-s.release
+	return s.Store.Query(key)
+}
+
+func TestTieredStoreConcurrentMiss(t *testing.T) {
+	directory := "./tieredboltdb"
+	os.RemoveAll(directory)
+	defer os.RemoveAll(directory)
+
+	boltStore := new(BoltStore)
+	InitializeStore(boltStore, &BoltStoreConfig{directory, 600, nil})
+	backing := &blockingBackend{Store: boltStore, querying: make(chan struct{}), release: make(chan struct{})}
+	tieredStore := new(TieredStore)
+	InitializeStore(tieredStore, &TieredStoreConfig{Backing: backing, BudgetBytes: 1 << 20})
+	defer ShutdownStore(tieredStore)
+	boltStore.Update("num:6.13", "m1")
+
+	done := make(chan []string)
+	go func() {
+		keys, _ := tieredStore.Query("num:6.13")
+		done <- keys
+	}()
+	<-backing.querying
+
+	// writes are not blocked by the read through, which must not cache the keys it read before the write
+	written := make(chan error)
+	go func() { written <- tieredStore.Update("num:6.13", "m2") }()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected write not blocked by read through")
+	}
+	close(backing.release)
+	<-done
+
+	go func() {
+		for range backing.querying {
+		}
+	}()
+	keys, err := tieredStore.Query("num:6.13")
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Expected write during read through visible, found %v, %v", keys, err)
+	}
+	close(backing.querying)
+}
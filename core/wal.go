@@ -0,0 +1,249 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WALSyncAlways fsyncs write ahead log after every change
+const WALSyncAlways string = "always"
+
+// WALSyncInterval fsyncs write ahead log periodically, changes since last fsync may be lost on crash
+const WALSyncInterval string = "interval"
+
+// WALSyncNone leaves flushing write ahead log to the operating system
+const WALSyncNone string = "none"
+
+const walLogFile string = "wal.log"
+const walRotatedLogFile string = "wal.log.1"
+const walSnapshotFile string = "snapshot.json"
+
+// walMetaOp records SetMeta in write ahead log
+const walMetaOp string = "meta"
+
+// walRecord single line of write ahead log
+type walRecord struct {
+	Op       string `json:"op"`
+	Property string `json:"property,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Meta     []byte `json:"meta,omitempty"`
+}
+
+// walSnapshot complete store written during compaction
+type walSnapshot struct {
+	Store map[string][]string `json:"store"`
+	Meta  map[string][]byte   `json:"meta"`
+}
+
+// writeAheadLog appends changes as JSON lines to a log file in dir
+// Compaction rotates the log, writes a snapshot of the store and removes the rotated log
+// Replay applies snapshot, rotated log (if compaction did not finish) and log in order,
+// replaying changes already part of the snapshot is harmless since the last change wins
+type writeAheadLog struct {
+	dir     string
+	sync    string
+	file    *os.File
+	records int
+	lock    sync.Mutex
+}
+
+func openWAL(dir, syncPolicy string) (*writeAheadLog, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{dir: dir, sync: syncPolicy}, nil
+}
+
+// replay snapshot and logs calling apply for every record, then opens the log for appending
+func (w *writeAheadLog) replay(apply func(record walRecord)) error {
+	snapshot, err := ioutil.ReadFile(filepath.Join(w.dir, walSnapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		var store walSnapshot
+		if err := json.Unmarshal(snapshot, &store); err != nil {
+			return err
+		}
+		for property, keys := range store.Store {
+			for _, key := range keys {
+				apply(walRecord{Op: ChangeAdd, Property: property, Key: key})
+			}
+		}
+		for name, value := range store.Meta {
+			apply(walRecord{Op: walMetaOp, Property: name, Meta: value})
+		}
+	}
+
+	if _, err := w.replayLog(filepath.Join(w.dir, walRotatedLogFile), apply); err != nil {
+		return err
+	}
+
+	records, err := w.replayLog(filepath.Join(w.dir, walLogFile), apply)
+	if err != nil {
+		return err
+	}
+
+	w.file, err = os.OpenFile(filepath.Join(w.dir, walLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	w.records = records
+	return err
+}
+
+// replayLog applies every complete record, a torn final record left by a crash is truncated
+// an undecodable record followed by further records is corruption, which fails the replay
+func (w *writeAheadLog) replayLog(path string, apply func(record walRecord)) (int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	records := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return records, nil
+		}
+		if err != nil && err != io.EOF {
+			return records, err
+		}
+
+		var record walRecord
+		if err == io.EOF {
+			return records, file.Truncate(offset)
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return records, file.Truncate(offset)
+			}
+			return records, fmt.Errorf("corrupt write ahead log %s at offset %d: %v", path, offset, err)
+		}
+
+		apply(record)
+		records++
+		offset += int64(len(line))
+	}
+}
+
+// append record to log, syncing according to policy
+func (w *writeAheadLog) append(record walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	w.records++
+
+	if w.sync == WALSyncAlways {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// flush fsyncs the log, used periodically with WALSyncInterval
+func (w *writeAheadLog) flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Sync()
+}
+
+// size number of records logged since the last compaction
+func (w *writeAheadLog) size() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.records
+}
+
+// rotate current log aside and start a new one, called with store locked
+// so the snapshot taken along with it covers the rotated log
+// when a previous compaction failed the rotated log is kept and current log continues,
+// it is replayed on top of the newer snapshot which is harmless
+func (w *writeAheadLog) rotate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, err := os.Stat(filepath.Join(w.dir, walRotatedLogFile)); err == nil {
+		return w.file.Sync()
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	logPath := filepath.Join(w.dir, walLogFile)
+	if err := os.Rename(logPath, filepath.Join(w.dir, walRotatedLogFile)); err != nil {
+		return err
+	}
+
+	var err error
+	w.file, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	w.records = 0
+	return err
+}
+
+// writeSnapshot atomically replaces the snapshot and removes the rotated log it covers
+func (w *writeAheadLog) writeSnapshot(snapshot walSnapshot) error {
+	jsSnapshot, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(w.dir, walSnapshotFile+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(jsSnapshot); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(w.dir, walSnapshotFile)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(w.dir, walRotatedLogFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *writeAheadLog) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}